@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// allowList restricts the clients answered to a set of subnets.
+type allowList struct {
+	networks []*net.IPNet
+
+	mu       sync.Mutex
+	refused  int // Queries refused since the last log line
+	loggedAt time.Time
+}
+
+// newAllowList parses `entries`, each a CIDR range or a single IP address.
+func newAllowList(entries []string) (*allowList, error) {
+	l := &allowList{}
+	for _, entry := range entries {
+		network, err := parseNetwork(entry)
+		if err != nil {
+			return nil, err
+		}
+		l.networks = append(l.networks, network)
+	}
+	return l, nil
+}
+
+// parseNetwork parses a CIDR range, or a single IP address as a range of its own.
+func parseNetwork(entry string) (*net.IPNet, error) {
+	entry = strings.TrimSpace(entry)
+	if _, network, err := net.ParseCIDR(entry); err == nil {
+		return network, nil
+	}
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid CIDR range or IP address %q", entry)
+	}
+	bits := 8 * net.IPv6len
+	if ip.To4() != nil {
+		ip, bits = ip.To4(), 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// Allow reports whether the client at `addr` is in one of the allowed subnets, or
+// local to the Unix socket. Refused clients are logged at most once a minute, with
+// how many were refused.
+func (l *allowList) Allow(addr net.Addr) bool {
+	// Clients of the Unix socket are local
+	if addr.Network() == "unix" {
+		return true
+	}
+
+	host := addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		for _, network := range l.networks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refused++
+	if now := time.Now(); now.Sub(l.loggedAt) > time.Minute {
+		log.Warn().Msgf("Refusing client %s outside `AUTODNS_ALLOW_CIDRS` (%d queries refused)", host, l.refused)
+		l.loggedAt = now
+		l.refused = 0
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// serviceInfo describes one registered service in the `/services` listing.
+type serviceInfo struct {
+	Container string `json:"container"`
+	Hostname  string `json:"hostname"`
+	IP        string `json:"ip,omitempty"`
+	IP6       string `json:"ip6,omitempty"`
+	CNAME     string `json:"cname,omitempty"`
+}
+
+// handleServices lists the services of the current snapshot as JSON.
+func handleServices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	infos := []serviceInfo{}
+	if snapshot := registry.Load(); snapshot != nil {
+		for _, name := range snapshot.Names() {
+			services, _ := snapshot.Lookup(name)
+			for _, service := range services {
+				info := serviceInfo{
+					Container: service.ContainerName,
+					Hostname:  service.HostnameLabel,
+					CNAME:     service.CNAME,
+				}
+				if service.IPAddress != nil {
+					info.IP = service.IPAddress.String()
+				}
+				if service.IPAddress6 != nil {
+					info.IP6 = service.IPAddress6.String()
+				}
+				infos = append(infos, info)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infos)
+}
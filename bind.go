@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/docker/docker/api/types/network"
+)
+
+// bindNetworkAddress resolves the gateway of the Docker network `name` and joins it with
+// the port of `listen`, so only containers on that network can reach the DNS servers.
+func bindNetworkAddress(name string, listen string) (string, error) {
+	_, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return "", fmt.Errorf("invalid listen address `%s`: %w", listen, err)
+	}
+
+	// The network is local to the first Docker host
+	cli, err := newDockerClient(dockerHosts()[0])
+	if err != nil {
+		return "", fmt.Errorf("failed to create Docker client: %w", err)
+	}
+	defer cli.Close()
+
+	ctx, cancel := dockerContext()
+	defer cancel()
+
+	inspect, err := cli.NetworkInspect(ctx, name, network.InspectOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect network `%s`: %w", name, err)
+	}
+
+	gateway := networkGateway(inspect)
+	if gateway == "" {
+		return "", fmt.Errorf("network `%s` has no gateway address to bind to", name)
+	}
+	return net.JoinHostPort(gateway, port), nil
+}
+
+// networkGateway returns the network's gateway address, preferring IPv4, or "" if it has none.
+func networkGateway(inspect network.Inspect) string {
+	var gateway string
+	for _, ipam := range inspect.IPAM.Config {
+		ip := net.ParseIP(ipam.Gateway)
+		if ip == nil {
+			continue
+		}
+		if ip.To4() != nil {
+			return ip.String()
+		}
+		if gateway == "" {
+			gateway = ip.String()
+		}
+	}
+	return gateway
+}
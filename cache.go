@@ -0,0 +1,139 @@
+package main
+
+import (
+	"container/list"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// upstreamCache holds forwarded answers with `AUTODNS_CACHE`, nil otherwise.
+var upstreamCache *responseCache
+
+// cacheKey identifies a question, along with the flags that change its answer.
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	edns   bool // Whether the query carried an OPT record, which the answer then echoes
+	do     bool // DNSSEC OK, asking for signatures
+	cd     bool // Checking Disabled, asking for unvalidated data
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+}
+
+// responseCache is a size-bounded LRU cache of upstream responses, each kept for the
+// lowest TTL among its records.
+type responseCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[cacheKey]*list.Element
+	order   *list.List // Most recently used first
+}
+
+func newResponseCache(size int) *responseCache {
+	return &responseCache{
+		size:    size,
+		entries: make(map[cacheKey]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func keyOf(r *dns.Msg) cacheKey {
+	q := r.Question[0]
+	key := cacheKey{name: strings.ToLower(q.Name), qtype: q.Qtype, qclass: q.Qclass, cd: r.CheckingDisabled}
+	if opt := r.IsEdns0(); opt != nil {
+		key.edns = true
+		key.do = opt.Do()
+	}
+	return key
+}
+
+// Get returns a copy of the cached response to `r` with its TTLs reduced by the time
+// spent in the cache, or nil if there is none or it has expired. The copy echoes the
+// question of `r`, and records owned by the question name take its case, as clients
+// randomizing that case (DNS 0x20) check it against their own.
+func (c *responseCache) Get(r *dns.Msg, now time.Time) *dns.Msg {
+	key := keyOf(r)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := element.Value.(*cacheEntry)
+	if !now.Before(entry.expires) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return nil
+	}
+	c.order.MoveToFront(element)
+
+	elapsed := uint32(now.Sub(entry.stored).Seconds())
+	m := entry.msg.Copy()
+	name := r.Question[0].Name
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			rr.Header().Ttl -= min(rr.Header().Ttl, elapsed)
+			if strings.EqualFold(rr.Header().Name, name) {
+				rr.Header().Name = name
+			}
+		}
+	}
+	m.Id = r.Id
+	m.Question = r.Question
+	return m
+}
+
+// Put caches the upstream response `m` to `r`. Failures and responses without any
+// record to take a TTL from aren't cached.
+func (c *responseCache) Put(r *dns.Msg, m *dns.Msg, now time.Time) {
+	if m.Truncated || (m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError) {
+		return
+	}
+
+	ttl := uint32(math.MaxUint32)
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				ttl = min(ttl, rr.Header().Ttl)
+			}
+		}
+	}
+	if ttl == math.MaxUint32 || ttl == 0 {
+		return
+	}
+
+	key := keyOf(r)
+	entry := &cacheEntry{key: key, msg: m.Copy(), stored: now, expires: now.Add(time.Duration(ttl) * time.Second)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+
+	// Evict the least recently used entries beyond the size bound
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// cacheQuery builds a query for `name` with the given EDNS0 and DNSSEC flags.
+func cacheQuery(name string, edns, do, cd bool) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetQuestion(name, dns.TypeA)
+	r.CheckingDisabled = cd
+	if edns {
+		r.SetEdns0(ednsUDPSize, do)
+	}
+	return r
+}
+
+func TestResponseCacheKeyFlags(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name           string
+		stored, looked *dns.Msg
+		hit            bool
+	}{
+		{"same flags", cacheQuery("example.org.", true, true, false), cacheQuery("example.org.", true, true, false), true},
+		{"name case", cacheQuery("example.org.", false, false, false), cacheQuery("EXAMPLE.org.", false, false, false), true},
+		{"DO split", cacheQuery("example.org.", true, true, false), cacheQuery("example.org.", true, false, false), false},
+		{"CD split", cacheQuery("example.org.", false, false, true), cacheQuery("example.org.", false, false, false), false},
+		{"EDNS0 split", cacheQuery("example.org.", true, false, false), cacheQuery("example.org.", false, false, false), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := newResponseCache(8)
+			resp := new(dns.Msg)
+			resp.SetReply(tt.stored)
+			rr, _ := dns.NewRR("example.org. 300 IN A 192.0.2.1")
+			resp.Answer = []dns.RR{rr}
+			cache.Put(tt.stored, resp, now)
+
+			if got := cache.Get(tt.looked, now); (got != nil) != tt.hit {
+				t.Fatalf("hit = %v, want %v", got != nil, tt.hit)
+			}
+		})
+	}
+}
+
+func TestResponseCacheTTL(t *testing.T) {
+	now := time.Now()
+	cache := newResponseCache(8)
+	r := cacheQuery("example.org.", false, false, false)
+	resp := new(dns.Msg)
+	resp.SetReply(r)
+	rr, _ := dns.NewRR("example.org. 300 IN A 192.0.2.1")
+	resp.Answer = []dns.RR{rr}
+	cache.Put(r, resp, now)
+
+	if got := cache.Get(r, now.Add(100*time.Second)); got == nil || got.Answer[0].Header().Ttl != 200 {
+		t.Fatalf("cached answer after 100s = %v, want a TTL of 200", got)
+	}
+	if got := cache.Get(r, now.Add(300*time.Second)); got != nil {
+		t.Fatalf("cached answer outlived its TTL")
+	}
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	now := time.Now()
+	cache := newResponseCache(2)
+	put := func(name string) *dns.Msg {
+		r := cacheQuery(name, false, false, false)
+		resp := new(dns.Msg)
+		resp.SetReply(r)
+		rr, _ := dns.NewRR(name + " 300 IN A 192.0.2.1")
+		resp.Answer = []dns.RR{rr}
+		cache.Put(r, resp, now)
+		return r
+	}
+
+	a, b := put("a.example."), put("b.example.")
+	cache.Get(a, now) // Makes b the least recently used
+	c := put("c.example.")
+
+	for _, tt := range []struct {
+		r   *dns.Msg
+		hit bool
+	}{{a, true}, {b, false}, {c, true}} {
+		if got := cache.Get(tt.r, now); (got != nil) != tt.hit {
+			t.Errorf("%s: hit = %v, want %v", tt.r.Question[0].Name, got != nil, tt.hit)
+		}
+	}
+}
+
+func TestResponseCacheQuestionCase(t *testing.T) {
+	now := time.Now()
+	cache := newResponseCache(8)
+	stored := cacheQuery("example.org.", false, false, false)
+	resp := new(dns.Msg)
+	resp.SetReply(stored)
+	for _, record := range []string{"example.org. 300 IN CNAME www.example.org.", "www.example.org. 300 IN A 192.0.2.1"} {
+		rr, _ := dns.NewRR(record)
+		resp.Answer = append(resp.Answer, rr)
+	}
+	cache.Put(stored, resp, now)
+
+	tests := []struct {
+		qname  string
+		owners []string // The owner of each answer record
+	}{
+		{"ExAmPlE.oRg.", []string{"ExAmPlE.oRg.", "www.example.org."}},
+		{"EXAMPLE.ORG.", []string{"EXAMPLE.ORG.", "www.example.org."}},
+		{"example.org.", []string{"example.org.", "www.example.org."}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.qname, func(t *testing.T) {
+			r := cacheQuery(tt.qname, false, false, false)
+			got := cache.Get(r, now)
+			if got == nil {
+				t.Fatal("cache miss")
+			}
+			if len(got.Question) != 1 || got.Question[0] != r.Question[0] {
+				t.Errorf("question = %v, want %v", got.Question, r.Question)
+			}
+			for i, rr := range got.Answer {
+				if rr.Header().Name != tt.owners[i] {
+					t.Errorf("answer %d owned by %q, want %q", i, rr.Header().Name, tt.owners[i])
+				}
+			}
+			if target := got.Answer[0].(*dns.CNAME).Target; target != "www.example.org." {
+				t.Errorf("CNAME target = %q, want it unchanged", target)
+			}
+		})
+	}
+}
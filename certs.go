@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// certCheckInterval spaces out the checks for renewed certificate files
+const certCheckInterval = 10 * time.Second
+
+// certReloader serves the certificate in `AUTODNS_TLS_CERT` and `AUTODNS_TLS_KEY`,
+// re-reading the files when they change on disk, so renewed certificates are picked
+// up by new connections without a restart.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time // Of the certificate and key files when last loaded
+	checked  time.Time
+}
+
+// newCertReloader loads the certificate and key, failing if they can't be read.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate returns the current certificate, reloading it first if either file
+// was modified since the last check. A failed reload keeps serving the previous certificate.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.checked) < certCheckInterval {
+		return r.cert, nil
+	}
+	r.checked = time.Now()
+
+	if modTimes, err := r.stat(); err == nil && modTimes != r.modTimes {
+		if err := r.reload(); err != nil {
+			log.Error().Err(err).Msg("Failed to reload TLS certificate, keeping the previous one")
+		} else {
+			log.Info().Msgf("Reloaded TLS certificate `%s`", r.certFile)
+		}
+	}
+	return r.cert, nil
+}
+
+// reload reads the certificate and key. Callers hold mu, or own the reloader alone.
+func (r *certReloader) reload() error {
+	modTimes, err := r.stat()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate `%s` and key `%s`: %w", r.certFile, r.keyFile, err)
+	}
+
+	r.cert = &cert
+	r.modTimes = modTimes
+	return nil
+}
+
+func (r *certReloader) stat() ([2]time.Time, error) {
+	var modTimes [2]time.Time
+	for i, path := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return modTimes, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	return modTimes, nil
+}
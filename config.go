@@ -0,0 +1,820 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the runtime settings, read from an optional YAML file and the environment.
+type Config struct {
+	// InstanceID identifies this AutoDNS instance in logs and metrics
+	InstanceID string `yaml:"instance_id"`
+
+	// LogFormat is `console` for human-readable logs or `json` for machine-parseable ones
+	LogFormat string `yaml:"log_format"`
+	// LogLevel is the minimum level logged: `debug`, `info`, `warn` or `error`
+	LogLevel string `yaml:"log_level"`
+
+	// DryRun prints the discovered records as a zone file and exits instead of serving them
+	DryRun bool `yaml:"dry_run"`
+
+	// Listen is the address both the UDP and TCP DNS servers bind to
+	Listen string `yaml:"listen"`
+
+	// BindNetwork is a Docker network whose gateway the DNS servers bind to instead of Listen's host
+	BindNetwork string `yaml:"bind_network"`
+
+	// DoTAddr is the address of the DNS-over-TLS listener, "" to disable it
+	DoTAddr string `yaml:"dot_addr"`
+	// DoHAddr is the address of the DNS-over-HTTPS endpoint, "" to disable it
+	DoHAddr string `yaml:"doh_addr"`
+	// UnixSocket is the path of a Unix socket serving DNS over a stream like TCP, "" to disable it
+	UnixSocket string `yaml:"unix_socket"`
+	// TLSCert and TLSKey are the paths of the certificate and key served over TLS
+	TLSCert string `yaml:"tls_cert"`
+	TLSKey  string `yaml:"tls_key"`
+
+	// MetricsAddr is the address of the Prometheus metrics endpoint, "" to disable it
+	MetricsAddr string `yaml:"metrics_addr"`
+
+	// HealthAddr is the address of the liveness and readiness endpoints, "" to disable them
+	HealthAddr string `yaml:"health_addr"`
+
+	// LabelPrefix namespaces the container labels AutoDNS reads, e.g. `<prefix>.hostname`
+	LabelPrefix string `yaml:"label_prefix"`
+
+	// Domain is appended to single-label hostnames, e.g. `grafana` becomes `grafana.home.arpa`
+	Domain string `yaml:"domain"`
+
+	// Zones lists the zones answered authoritatively; by default the domain and dynamic zone
+	Zones []string `yaml:"zones"`
+	// PTRBestEffort answers reverse queries of known addresses outside Zones too
+	PTRBestEffort bool `yaml:"ptr_best_effort"`
+
+	// XFRAllow lists the client IPs or CIDR ranges allowed to transfer the domain with AXFR
+	XFRAllow []string `yaml:"xfr_allow"`
+
+	// NSName is the name server answered for NS queries on Domain, SOAMname by default
+	NSName string `yaml:"ns_name"`
+	// SOAMname is the primary name server of Domain's SOA record, `ns.<domain>` by default
+	SOAMname string `yaml:"soa_mname"`
+	// SOARname is the responsible mailbox of Domain's SOA record, `hostmaster.<domain>` by default
+	SOARname string `yaml:"soa_rname"`
+
+	// DefaultNetwork is the network containers are served on unless they pick one
+	DefaultNetwork string `yaml:"default_network"`
+	// ExcludeBridge serves a container on Docker's `bridge` network and a single other
+	// one on the latter; on more, `bridge` stays the fallback
+	ExcludeBridge bool `yaml:"exclude_bridge"`
+	// HostIP is the address host-network containers resolve to, "" to detect it
+	HostIP string `yaml:"host_ip"`
+
+	// TTL is the default TTL of served records, in seconds
+	TTL uint32 `yaml:"ttl"`
+	// TTLJitter randomizes each address answer's TTL within this percentage of it, 0 disables it
+	TTLJitter int `yaml:"ttl_jitter"`
+
+	// NegativeTTL is the SOA minimum, which resolvers use to cache negative answers, in seconds
+	NegativeTTL uint32 `yaml:"negative_ttl"`
+
+	// RoundRobin shuffles the order of multiple addresses on every query
+	RoundRobin bool `yaml:"round_robin"`
+	// Order is how multiple addresses are ordered: "stable", "random", "affinity",
+	// "proximity" or "rotate"; it defaults to "random" with RoundRobin and "stable" without
+	Order string `yaml:"order"`
+	// MaxAnswers caps the addresses answered per A or AAAA query, 0 for no limit
+	MaxAnswers int `yaml:"max_answers"`
+	// PrefetchHints adds a name's other address and HTTPS records to the additional
+	// section of A, AAAA and HTTPS answers, sparing clients the follow-up queries
+	PrefetchHints bool `yaml:"prefetch_hints"`
+
+	// Compress shrinks responses with DNS name compression, off only to debug their wire format
+	Compress bool `yaml:"compress"`
+
+	// Prefer is the address family served where a query doesn't pick one: `v4`, `v6` or `both`
+	Prefer string `yaml:"prefer"`
+
+	// Upstream lists the resolvers unknown names are forwarded to, tried in turn; empty to disable forwarding
+	Upstream List `yaml:"upstream"`
+	// UpstreamTimeout bounds each forwarded query to a single upstream
+	UpstreamTimeout time.Duration `yaml:"upstream_timeout"`
+	// UpstreamSourceIP is the local address forwarded queries are sent from, "" to let
+	// the routing table pick
+	UpstreamSourceIP string `yaml:"upstream_source_ip"`
+	// Cache keeps forwarded answers in memory until their TTL expires
+	Cache bool `yaml:"cache"`
+	// CacheSize bounds the number of cached answers, evicting the least recently used
+	CacheSize int `yaml:"cache_size"`
+
+	// TraefikDefault names the Traefik instance used by containers that don't pick one
+	TraefikDefault string `yaml:"traefik_default"`
+	// TraefikRequireHealthy withholds Traefik-routed services while Traefik is unhealthy
+	TraefikRequireHealthy bool `yaml:"traefik_require_healthy"`
+	// TraefikProbePort, if non-zero, is a TCP port on Traefik that must accept connections
+	TraefikProbePort int `yaml:"traefik_probe_port"`
+	// TraefikProbeTimeout bounds the TCP probe to Traefik
+	TraefikProbeTimeout time.Duration `yaml:"traefik_probe_timeout"`
+	// TraefikEntrypointPorts maps Traefik entrypoint names to ports, for SRV records of routed services
+	TraefikEntrypointPorts map[string]uint16 `yaml:"traefik_entrypoint_ports"`
+	// TraefikEntrypoints limits Traefik-routed hosts to routers bound to one of these entrypoints
+	TraefikEntrypoints []string `yaml:"traefik_entrypoints"`
+	// TraefikStripSuffix is removed from router hosts ending with it, e.g. a public `example.com`
+	TraefikStripSuffix string `yaml:"traefik_strip_suffix"`
+	// TraefikAppendSuffix replaces the stripped suffix, e.g. an internal `example.internal`
+	TraefikAppendSuffix string `yaml:"traefik_append_suffix"`
+
+	// AllowCIDRs lists the client subnets answered, refusing all others; empty to answer everyone
+	AllowCIDRs []string `yaml:"allow_cidrs"`
+
+	// RateLimit caps the queries per second answered for each client IP, 0 means unlimited
+	RateLimit float64 `yaml:"rate_limit"`
+
+	// TCPMaxConnections caps concurrent TCP connections, 0 means unlimited
+	TCPMaxConnections int `yaml:"tcp_max_connections"`
+	// TCPIdleTimeout closes TCP connections idle for longer than this
+	TCPIdleTimeout time.Duration `yaml:"tcp_idle_timeout"`
+
+	// DynamicZone is a zone whose names encode their own IP address, e.g. `ip-10-0-0-5.<zone>`
+	DynamicZone string `yaml:"dynamic_zone"`
+	// DynamicPattern matches the part of a name in DynamicZone before the zone itself
+	DynamicPattern Pattern `yaml:"dynamic_pattern"`
+	// DynamicTemplate expands DynamicPattern's submatches into an IP address
+	DynamicTemplate string `yaml:"dynamic_template"`
+
+	// NameZone is a zone where every container resolves by its name and short ID, "" to disable
+	NameZone string `yaml:"name_zone"`
+
+	// StatusName is the reserved name answering with a status TXT record, "" to disable
+	StatusName string `yaml:"status_name"`
+	// Identity answers the `id.server` and `hostname.bind` CHAOS TXT probes, the machine hostname by default
+	Identity string `yaml:"identity"`
+	// NSID is returned in the EDNS0 NSID option to queries requesting it, "" to disable
+	NSID string `yaml:"nsid"`
+	// DebugRecords answers `_autodns.<hostname>` TXT queries with where the hostname's records come from
+	DebugRecords bool `yaml:"debug_records"`
+
+	// MinTTL is the lowest TTL served when capping TTLs to a container's remaining lifetime
+	MinTTL uint32 `yaml:"min_ttl"`
+
+	// Strict drops hostnames claimed by several containers with different addresses
+	Strict bool `yaml:"strict"`
+
+	// ComposeAutoname names unlabelled containers `<service>.<project>` from their Compose labels
+	ComposeAutoname bool `yaml:"compose_autoname"`
+
+	// Swarm also discovers Swarm services through the services API
+	Swarm bool `yaml:"swarm"`
+
+	// UseContainerHostname names unlabelled containers after their `--hostname` and `--domainname`
+	UseContainerHostname bool `yaml:"use_container_hostname"`
+	// UseNetworkAliases also registers the `--network-alias` names of containers, under Domain
+	UseNetworkAliases bool `yaml:"use_network_aliases"`
+
+	// IncludeStopped registers stopped containers too, instead of only running ones
+	IncludeStopped bool `yaml:"include_stopped"`
+	// LabelFilter limits discovery to containers with this label, as `key` or `key=value`
+	LabelFilter string `yaml:"label_filter"`
+	// Networks limits discovery to containers attached to at least one of these networks
+	Networks []string `yaml:"networks"`
+
+	// WebhookURL receives a POST with the changed hostnames whenever discovery changes the records
+	WebhookURL string `yaml:"webhook_url"`
+
+	// DockerHosts lists the Docker daemons to discover containers on, e.g. `tcp://host:2376`; empty for the local one
+	DockerHosts List `yaml:"docker_hosts"`
+	// DockerTimeout bounds each discovery run's calls to the Docker API
+	DockerTimeout time.Duration `yaml:"docker_timeout"`
+
+	// DiscoveryMaxBackoff caps the wait between retries while Docker is unreachable at startup
+	DiscoveryMaxBackoff time.Duration `yaml:"discovery_max_backoff"`
+	// EmptyRetryInterval re-runs discovery while it finds no containers at startup, 0 disables it
+	EmptyRetryInterval time.Duration `yaml:"empty_retry_interval"`
+
+	// WatchEvents re-runs discovery when Docker reports containers starting or stopping
+	WatchEvents bool `yaml:"watch_events"`
+	// EventDebounce is how long to wait for a burst of events to settle before re-discovering
+	EventDebounce time.Duration `yaml:"event_debounce"`
+	// RefreshInterval re-runs discovery periodically, 0 disables it
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+
+	// Static lists hostnames served independently of Docker
+	Static []StaticHost `yaml:"static"`
+	// ApexIP is the address the bare Domain resolves to, "" for none
+	ApexIP string `yaml:"apex_ip"`
+
+	// Zonefile is a BIND-style zone file whose records are served alongside discovered ones
+	Zonefile string `yaml:"zonefile"`
+	// ZonefileOverride makes the zone file's records win over discovered ones of the same name
+	ZonefileOverride bool `yaml:"zonefile_override"`
+
+	// HostsFile is a file in `/etc/hosts` format whose entries fill in names nothing else serves
+	HostsFile string `yaml:"hosts_file"`
+
+	// MaintenanceIP answers every in-zone address query during maintenance, "" for none
+	MaintenanceIP string `yaml:"maintenance_ip"`
+}
+
+// StaticHost maps a hostname to a fixed IP address.
+type StaticHost struct {
+	Hostname string `yaml:"hostname"`
+	IP       string `yaml:"ip"`
+}
+
+// Pattern is a regular expression that can be read from YAML.
+type Pattern struct {
+	*regexp.Regexp
+}
+
+// UnmarshalYAML compiles the pattern, rejecting invalid expressions.
+func (p *Pattern) UnmarshalYAML(node *yaml.Node) error {
+	re, err := regexp.Compile(node.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: invalid regular expression: %w", node.Line, err)
+	}
+	p.Regexp = re
+	return nil
+}
+
+// List is a list of strings that can be read from YAML as a sequence or a comma-separated scalar.
+type List []string
+
+// UnmarshalYAML accepts both `a, b` and `[a, b]`.
+func (l *List) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.ScalarNode {
+		return node.Decode((*[]string)(l))
+	}
+
+	*l = nil
+	for _, item := range strings.Split(node.Value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// config is the effective configuration, loaded once at startup.
+var config Config
+
+// defaultConfig returns the configuration used when nothing overrides it.
+func defaultConfig() Config {
+	return Config{
+		InstanceID: defaultInstanceID(),
+		Identity:   defaultInstanceID(),
+
+		LogFormat: "console",
+		LogLevel:  "info",
+
+		Listen: ":53",
+
+		DefaultNetwork: "bridge",
+		ExcludeBridge:  true,
+
+		LabelPrefix: "com.autodns",
+
+		TTL:         defaultTTL,
+		NegativeTTL: 60,
+
+		RoundRobin: true,
+
+		Compress: true,
+
+		Prefer: "both",
+
+		UpstreamTimeout: 2 * time.Second,
+		CacheSize:       1000,
+
+		TraefikProbeTimeout: 2 * time.Second,
+
+		TCPIdleTimeout: 8 * time.Second,
+
+		DynamicPattern:  Pattern{regexp.MustCompile(`^ip-(\d{1,3})-(\d{1,3})-(\d{1,3})-(\d{1,3})$`)},
+		DynamicTemplate: "$1.$2.$3.$4",
+
+		StatusName: "version.autodns.",
+
+		DockerTimeout: 10 * time.Second,
+
+		DiscoveryMaxBackoff: 30 * time.Second,
+		EmptyRetryInterval:  30 * time.Second,
+
+		WatchEvents:   true,
+		EventDebounce: time.Second,
+	}
+}
+
+// loadConfig starts from the defaults, applies the YAML file named by `AUTODNS_CONFIG`
+// if any, then lets `AUTODNS_*` environment variables override individual settings.
+func loadConfig() (Config, error) {
+	file := defaultConfig()
+	if path := os.Getenv("AUTODNS_CONFIG"); path != "" {
+		if err := loadConfigFile(path, &file); err != nil {
+			return file, err
+		}
+	}
+
+	dynamicPattern, err := envPattern("AUTODNS_DYNAMIC_PATTERN", file.DynamicPattern)
+	if err != nil {
+		return file, err
+	}
+
+	cfg := Config{
+		InstanceID: envString("AUTODNS_INSTANCE_ID", file.InstanceID),
+
+		LogFormat: strings.ToLower(envString("AUTODNS_LOG_FORMAT", file.LogFormat)),
+		LogLevel:  strings.ToLower(envString("AUTODNS_LOG_LEVEL", file.LogLevel)),
+
+		DryRun: envBool("AUTODNS_DRY_RUN", file.DryRun),
+
+		Listen:      envString("AUTODNS_LISTEN", file.Listen),
+		BindNetwork: envString("AUTODNS_BIND_NETWORK", file.BindNetwork),
+
+		DoTAddr: envString("AUTODNS_DOT_ADDR", file.DoTAddr),
+		DoHAddr: envString("AUTODNS_DOH_ADDR", file.DoHAddr),
+		TLSCert: envString("AUTODNS_TLS_CERT", file.TLSCert),
+		TLSKey:  envString("AUTODNS_TLS_KEY", file.TLSKey),
+
+		UnixSocket: envString("AUTODNS_UNIX_SOCKET", file.UnixSocket),
+
+		MetricsAddr: envString("AUTODNS_METRICS_ADDR", file.MetricsAddr),
+
+		HealthAddr: envString("AUTODNS_HEALTH_ADDR", file.HealthAddr),
+
+		LabelPrefix: strings.Trim(envString("AUTODNS_LABEL_PREFIX", file.LabelPrefix), ". "),
+
+		Domain: strings.Trim(strings.ToLower(envString("AUTODNS_DOMAIN", file.Domain)), ". "),
+
+		Zones:         envZones("AUTODNS_ZONES", file.Zones),
+		PTRBestEffort: envBool("AUTODNS_PTR_BEST_EFFORT", file.PTRBestEffort),
+
+		XFRAllow: envList("AUTODNS_XFR_ALLOW", file.XFRAllow),
+
+		NSName:   fqdnOrEmpty(envString("AUTODNS_NS_NAME", file.NSName)),
+		SOAMname: fqdnOrEmpty(envString("AUTODNS_SOA_MNAME", file.SOAMname)),
+		SOARname: fqdnOrEmpty(envString("AUTODNS_SOA_RNAME", file.SOARname)),
+
+		DefaultNetwork: envString("AUTODNS_DEFAULT_NETWORK", file.DefaultNetwork),
+		ExcludeBridge:  envBool("AUTODNS_EXCLUDE_BRIDGE", file.ExcludeBridge),
+		HostIP:         envString("AUTODNS_HOST_IP", file.HostIP),
+
+		TTL:         envTTL("AUTODNS_TTL", file.TTL),
+		TTLJitter:   envInt("AUTODNS_TTL_JITTER", file.TTLJitter),
+		NegativeTTL: uint32(max(envInt("AUTODNS_NEGATIVE_TTL", int(file.NegativeTTL)), 0)),
+
+		RoundRobin:    envBool("AUTODNS_ROUND_ROBIN", file.RoundRobin),
+		Order:         strings.ToLower(envString("AUTODNS_ORDER", file.Order)),
+		MaxAnswers:    max(envInt("AUTODNS_MAX_ANSWERS", file.MaxAnswers), 0),
+		PrefetchHints: envBool("AUTODNS_PREFETCH_HINTS", file.PrefetchHints),
+
+		Compress: envBool("AUTODNS_COMPRESS", file.Compress),
+
+		Prefer: strings.ToLower(envString("AUTODNS_PREFER", file.Prefer)),
+
+		Upstream:         envUpstreams("AUTODNS_UPSTREAM", file.Upstream),
+		UpstreamTimeout:  envDuration("AUTODNS_UPSTREAM_TIMEOUT", file.UpstreamTimeout),
+		UpstreamSourceIP: envString("AUTODNS_UPSTREAM_SOURCE_IP", file.UpstreamSourceIP),
+		Cache:            envBool("AUTODNS_CACHE", file.Cache),
+		CacheSize:        max(envInt("AUTODNS_CACHE_SIZE", file.CacheSize), 1),
+
+		TraefikDefault: envString("AUTODNS_TRAEFIK_DEFAULT", file.TraefikDefault),
+
+		TraefikRequireHealthy: envBool("AUTODNS_TRAEFIK_REQUIRE_HEALTHY", file.TraefikRequireHealthy),
+		TraefikProbePort:      envInt("AUTODNS_TRAEFIK_PROBE_PORT", file.TraefikProbePort),
+		TraefikProbeTimeout:   envDuration("AUTODNS_TRAEFIK_PROBE_TIMEOUT", file.TraefikProbeTimeout),
+
+		TraefikEntrypointPorts: envPortMap("AUTODNS_TRAEFIK_ENTRYPOINT_PORTS", file.TraefikEntrypointPorts),
+		TraefikEntrypoints:     envList("AUTODNS_TRAEFIK_ENTRYPOINTS", file.TraefikEntrypoints),
+
+		TraefikStripSuffix:  strings.Trim(strings.ToLower(envString("AUTODNS_TRAEFIK_STRIP_SUFFIX", file.TraefikStripSuffix)), ". "),
+		TraefikAppendSuffix: strings.Trim(strings.ToLower(envString("AUTODNS_TRAEFIK_APPEND_SUFFIX", file.TraefikAppendSuffix)), ". "),
+
+		AllowCIDRs: envList("AUTODNS_ALLOW_CIDRS", file.AllowCIDRs),
+
+		RateLimit: envFloat("AUTODNS_RATE_LIMIT", file.RateLimit),
+
+		TCPMaxConnections: envInt("AUTODNS_TCP_MAX_CONNECTIONS", file.TCPMaxConnections),
+		TCPIdleTimeout:    envDuration("AUTODNS_TCP_IDLE_TIMEOUT", file.TCPIdleTimeout),
+
+		DynamicZone:     fqdnOrEmpty(envString("AUTODNS_DYNAMIC_ZONE", file.DynamicZone)),
+		DynamicPattern:  dynamicPattern,
+		DynamicTemplate: envString("AUTODNS_DYNAMIC_TEMPLATE", file.DynamicTemplate),
+
+		NameZone: fqdnOrEmpty(envString("AUTODNS_NAME_ZONE", file.NameZone)),
+
+		StatusName:   fqdnOrEmpty(envOptional("AUTODNS_STATUS_NAME", file.StatusName)),
+		Identity:     envString("AUTODNS_IDENTITY", file.Identity),
+		NSID:         envString("AUTODNS_NSID", file.NSID),
+		DebugRecords: envBool("AUTODNS_DEBUG_RECORDS", file.DebugRecords),
+
+		MinTTL: uint32(max(envInt("AUTODNS_MIN_TTL", int(file.MinTTL)), 0)),
+
+		Strict: envBool("AUTODNS_STRICT", file.Strict),
+
+		ComposeAutoname: envBool("AUTODNS_COMPOSE_AUTONAME", file.ComposeAutoname),
+
+		UseContainerHostname: envBool("AUTODNS_USE_CONTAINER_HOSTNAME", file.UseContainerHostname),
+		UseNetworkAliases:    envBool("AUTODNS_USE_NETWORK_ALIASES", file.UseNetworkAliases),
+
+		Swarm: envBool("AUTODNS_SWARM", file.Swarm),
+
+		IncludeStopped: envBool("AUTODNS_INCLUDE_STOPPED", file.IncludeStopped),
+		LabelFilter:    envString("AUTODNS_LABEL_FILTER", file.LabelFilter),
+		Networks:       envList("AUTODNS_NETWORKS", file.Networks),
+
+		WebhookURL: envString("AUTODNS_WEBHOOK_URL", file.WebhookURL),
+
+		DockerHosts:   envList("AUTODNS_DOCKER_HOSTS", file.DockerHosts),
+		DockerTimeout: envDuration("AUTODNS_DOCKER_TIMEOUT", file.DockerTimeout),
+
+		DiscoveryMaxBackoff: envDuration("AUTODNS_DISCOVERY_MAX_BACKOFF", file.DiscoveryMaxBackoff),
+		EmptyRetryInterval:  envDuration("AUTODNS_EMPTY_RETRY_INTERVAL", file.EmptyRetryInterval),
+
+		WatchEvents:   envBool("AUTODNS_WATCH_EVENTS", file.WatchEvents),
+		EventDebounce: envDuration("AUTODNS_EVENT_DEBOUNCE", file.EventDebounce),
+
+		RefreshInterval: envDuration("AUTODNS_REFRESH_INTERVAL", file.RefreshInterval),
+
+		Static: append(file.Static, envStaticHosts("AUTODNS_STATIC")...),
+		ApexIP: envString("AUTODNS_APEX_IP", file.ApexIP),
+
+		Zonefile:         envString("AUTODNS_ZONEFILE", file.Zonefile),
+		ZonefileOverride: envBool("AUTODNS_ZONEFILE_OVERRIDE", file.ZonefileOverride),
+
+		HostsFile: envString("AUTODNS_HOSTS_FILE", file.HostsFile),
+
+		MaintenanceIP: envString("AUTODNS_MAINTENANCE_IP", file.MaintenanceIP),
+	}
+
+	// The SOA names default to names within the managed domain
+	if cfg.Domain != "" {
+		if cfg.SOAMname == "" {
+			cfg.SOAMname = "ns." + cfg.Domain + "."
+		}
+		if cfg.SOARname == "" {
+			cfg.SOARname = "hostmaster." + cfg.Domain + "."
+		}
+		if cfg.NSName == "" {
+			cfg.NSName = cfg.SOAMname
+		}
+	}
+
+	// A certificate alone enables DNS-over-TLS on the standard port
+	if cfg.DoTAddr == "" && cfg.TLSCert != "" && cfg.TLSKey != "" {
+		cfg.DoTAddr = ":853"
+	}
+	if cfg.DoTAddr != "" && (cfg.TLSCert == "" || cfg.TLSKey == "") {
+		return cfg, fmt.Errorf("DNS-over-TLS on `%s` needs both `AUTODNS_TLS_CERT` and `AUTODNS_TLS_KEY`", cfg.DoTAddr)
+	}
+
+	if cfg.ApexIP != "" && (cfg.Domain == "" || net.ParseIP(cfg.ApexIP) == nil) {
+		return cfg, fmt.Errorf("invalid apex address `%s`, expected an IP address and `AUTODNS_DOMAIN` to be set", cfg.ApexIP)
+	}
+
+	if cfg.TTLJitter < 0 || cfg.TTLJitter > 100 {
+		return cfg, fmt.Errorf("invalid TTL jitter %d, expected a percentage between 0 and 100", cfg.TTLJitter)
+	}
+
+	if cfg.HostIP != "" && net.ParseIP(cfg.HostIP) == nil {
+		return cfg, fmt.Errorf("invalid host address `%s`, expected an IP address", cfg.HostIP)
+	}
+
+	if cfg.UpstreamSourceIP != "" && net.ParseIP(cfg.UpstreamSourceIP) == nil {
+		return cfg, fmt.Errorf("invalid upstream source address `%s`, expected an IP address", cfg.UpstreamSourceIP)
+	}
+	if cfg.MaintenanceIP != "" && net.ParseIP(cfg.MaintenanceIP) == nil {
+		return cfg, fmt.Errorf("invalid maintenance address `%s`, expected an IP address", cfg.MaintenanceIP)
+	}
+
+	if _, err := newAllowList(cfg.AllowCIDRs); err != nil {
+		return cfg, fmt.Errorf("invalid `AUTODNS_ALLOW_CIDRS`: %w", err)
+	}
+
+	if cfg.Order == "" {
+		cfg.Order = "stable"
+		if cfg.RoundRobin {
+			cfg.Order = "random"
+		}
+	}
+	if _, ok := answerOrders[cfg.Order]; !ok {
+		return cfg, fmt.Errorf("invalid answer order `%s`, expected `stable`, `random`, `affinity`, `proximity` or `rotate`", cfg.Order)
+	}
+
+	if cfg.Prefer != "v4" && cfg.Prefer != "v6" && cfg.Prefer != "both" {
+		return cfg, fmt.Errorf("invalid address family preference `%s`, expected `v4`, `v6` or `both`", cfg.Prefer)
+	}
+
+	return cfg, nil
+}
+
+// logConfig logs the effective configuration as a single structured line, so it's
+// clear which settings took effect. TLS keys are shown by path and the webhook URL,
+// which may embed a token, only by whether it is set.
+func logConfig(cfg Config) {
+	var features []string
+	for name, enabled := range map[string]bool{
+		"cache":                   cfg.Cache,
+		"compose_autoname":        cfg.ComposeAutoname,
+		"compress":                cfg.Compress,
+		"debug_records":           cfg.DebugRecords,
+		"dry_run":                 cfg.DryRun,
+		"exclude_bridge":          cfg.ExcludeBridge,
+		"include_stopped":         cfg.IncludeStopped,
+		"prefetch_hints":          cfg.PrefetchHints,
+		"ptr_best_effort":         cfg.PTRBestEffort,
+		"round_robin":             cfg.RoundRobin,
+		"strict":                  cfg.Strict,
+		"swarm":                   cfg.Swarm,
+		"traefik_require_healthy": cfg.TraefikRequireHealthy,
+		"use_container_hostname":  cfg.UseContainerHostname,
+		"use_network_aliases":     cfg.UseNetworkAliases,
+		"watch_events":            cfg.WatchEvents,
+		"webhook":                 cfg.WebhookURL != "",
+		"zonefile_override":       cfg.ZonefileOverride,
+	} {
+		if enabled {
+			features = append(features, name)
+		}
+	}
+	slices.Sort(features)
+
+	log.Info().
+		Str("listen", cfg.Listen).
+		Str("bind_network", cfg.BindNetwork).
+		Str("dot_addr", cfg.DoTAddr).
+		Str("doh_addr", cfg.DoHAddr).
+		Str("unix_socket", cfg.UnixSocket).
+		Str("tls_cert", cfg.TLSCert).
+		Str("tls_key", cfg.TLSKey).
+		Str("metrics_addr", cfg.MetricsAddr).
+		Str("health_addr", cfg.HealthAddr).
+		Str("domain", cfg.Domain).
+		Strs("zones", cfg.Zones).
+		Uint32("ttl", cfg.TTL).
+		Uint32("negative_ttl", cfg.NegativeTTL).
+		Strs("upstream", cfg.Upstream).
+		Str("upstream_source_ip", cfg.UpstreamSourceIP).
+		Str("default_network", cfg.DefaultNetwork).
+		Str("host_ip", cfg.HostIP).
+		Str("label_prefix", cfg.LabelPrefix).
+		Str("label_filter", cfg.LabelFilter).
+		Strs("docker_hosts", cfg.DockerHosts).
+		Str("order", cfg.Order).
+		Str("prefer", cfg.Prefer).
+		Int("max_answers", cfg.MaxAnswers).
+		Int("ttl_jitter", cfg.TTLJitter).
+		Dur("refresh_interval", cfg.RefreshInterval).
+		Dur("empty_retry_interval", cfg.EmptyRetryInterval).
+		Str("zonefile", cfg.Zonefile).
+		Str("hosts_file", cfg.HostsFile).
+		Str("maintenance_ip", cfg.MaintenanceIP).
+		Strs("features", features).
+		Msg("Effective configuration")
+}
+
+// loadConfigFile decodes the YAML file at `path` over `cfg`, keeping any settings it doesn't mention.
+func loadConfigFile(path string, cfg *Config) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer f.Close()
+
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true) // Catch typos in setting names
+	if err := decoder.Decode(cfg); err != nil {
+		return fmt.Errorf("failed to parse config file `%s`: %w", path, err)
+	}
+	return nil
+}
+
+// defaultInstanceID returns the machine hostname, or `autodns` if it can't be determined.
+func defaultInstanceID() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return "autodns"
+	}
+	return hostname
+}
+
+// envOptional returns the value of the environment variable `key` even if empty, or `def` if unset.
+// This lets an empty value explicitly disable a feature that is on by default.
+func envOptional(key, def string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return def
+}
+
+// envString returns the value of the environment variable `key`, or `def` if unset or empty.
+func envString(key, def string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return def
+}
+
+// envBool returns the boolean value of the environment variable `key`, or `def` if unset or invalid.
+func envBool(key string, def bool) bool {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return def
+	}
+
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Warn().Msgf("Invalid boolean `%s` for `%s`, using default `%t`", value, key, def)
+		return def
+	}
+	return parsed
+}
+
+// envInt returns the integer value of the environment variable `key`, or `def` if unset or invalid.
+func envInt(key string, def int) int {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return def
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Warn().Msgf("Invalid integer `%s` for `%s`, using default `%d`", value, key, def)
+		return def
+	}
+	return parsed
+}
+
+// envFloat returns the decimal value of the environment variable `key`, or `def` if unset or invalid.
+func envFloat(key string, def float64) float64 {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return def
+	}
+
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Warn().Msgf("Invalid number `%s` for `%s`, using default `%g`", value, key, def)
+		return def
+	}
+	return parsed
+}
+
+// envDuration returns the duration value of the environment variable `key`, or `def` if unset or invalid.
+func envDuration(key string, def time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return def
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		log.Warn().Msgf("Invalid duration `%s` for `%s`, using default `%s`", value, key, def)
+		return def
+	}
+	return parsed
+}
+
+// envPortMap parses the environment variable `key` as a comma-separated list of `name=port` pairs,
+// or returns `def` if unset. Malformed pairs are logged and skipped.
+func envPortMap(key string, def map[string]uint16) map[string]uint16 {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return def
+	}
+
+	ports := make(map[string]uint16)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		name, portValue, ok := strings.Cut(pair, "=")
+		port, err := strconv.ParseUint(strings.TrimSpace(portValue), 10, 16)
+		if !ok || err != nil || strings.TrimSpace(name) == "" {
+			log.Warn().Msgf("Invalid `name=port` pair `%s` for `%s`, skipping", pair, key)
+			continue
+		}
+		ports[strings.TrimSpace(name)] = uint16(port)
+	}
+
+	return ports
+}
+
+// envTTL returns the environment variable `key` as a positive TTL in seconds, or `def` if unset or invalid.
+func envTTL(key string, def uint32) uint32 {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return def
+	}
+
+	ttl, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || ttl == 0 {
+		log.Warn().Msgf("Invalid TTL `%s` for `%s`, using default `%d`", value, key, def)
+		return def
+	}
+	return uint32(ttl)
+}
+
+// envStaticHosts parses the environment variable `key` as a comma-separated list of
+// `hostname=ip` pairs. Malformed pairs are logged and skipped.
+func envStaticHosts(key string) []StaticHost {
+	var hosts []StaticHost
+	for _, pair := range strings.Split(os.Getenv(key), ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		hostname, ip, ok := strings.Cut(pair, "=")
+		if !ok {
+			log.Warn().Msgf("Invalid `hostname=ip` pair `%s` for `%s`, skipping", pair, key)
+			continue
+		}
+		hosts = append(hosts, StaticHost{Hostname: strings.TrimSpace(hostname), IP: strings.TrimSpace(ip)})
+	}
+	return hosts
+}
+
+// envList splits the environment variable `key` on commas, or returns `def` if unset or empty.
+func envList(key string, def []string) []string {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return def
+	}
+
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// envZones parses the environment variable `key` as a comma-separated list of zones,
+// or returns `def` if unset. Zones are returned as lowercase fully-qualified names.
+func envZones(key string, def []string) []string {
+	var zones []string
+	for _, zone := range envList(key, def) {
+		if zone = fqdnOrEmpty(zone); zone != "" {
+			zones = append(zones, zone)
+		}
+	}
+	return zones
+}
+
+// envUpstreams parses the environment variable `key` as a comma-separated list of
+// resolver addresses, or returns `def` if unset. Addresses without a port get port 53.
+func envUpstreams(key string, def List) List {
+	var upstreams List
+	for _, upstream := range envList(key, def) {
+		upstreams = append(upstreams, withDefaultPort(upstream, "53"))
+	}
+	return upstreams
+}
+
+// withDefaultPort returns `value` as a `host:port` address, adding `defaultPort` when
+// no port is given, or "" if `value` is empty.
+func withDefaultPort(value, defaultPort string) string {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return ""
+	}
+	if _, _, err := net.SplitHostPort(value); err != nil {
+		return net.JoinHostPort(strings.Trim(value, "[]"), defaultPort)
+	}
+	return value
+}
+
+// fqdnOrEmpty returns `value` as a lowercase fully-qualified domain name, or "" if empty.
+func fqdnOrEmpty(value string) string {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return ""
+	}
+	return dns.Fqdn(strings.ToLower(value))
+}
+
+// envPattern compiles the environment variable `key`, or returns `def` if unset.
+func envPattern(key string, def Pattern) (Pattern, error) {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return def, nil
+	}
+
+	re, err := regexp.Compile(value)
+	if err != nil {
+		return def, fmt.Errorf("invalid regular expression `%s` for `%s`: %w", value, key, err)
+	}
+	return Pattern{re}, nil
+}
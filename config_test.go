@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigDynamicPattern(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     string
+		file    string
+		pattern string // The expression loaded, "" when loading fails
+	}{
+		{"default", "", "", defaultConfig().DynamicPattern.String()},
+		{"from the environment", `^(\d+)-(\d+)-(\d+)-(\d+)$`, "", `^(\d+)-(\d+)-(\d+)-(\d+)$`},
+		{"invalid in the environment", `^ip-(\d+$`, "", ""},
+		{"from the file", "", `dynamic_pattern: '^h(\d+)$'`, `^h(\d+)$`},
+		{"invalid in the file", "", `dynamic_pattern: '^h(\d+$'`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("AUTODNS_DYNAMIC_PATTERN", tt.env)
+			t.Setenv("AUTODNS_CONFIG", "")
+			if tt.file != "" {
+				path := filepath.Join(t.TempDir(), "autodns.yml")
+				if err := os.WriteFile(path, []byte(tt.file+"\n"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				t.Setenv("AUTODNS_CONFIG", path)
+			}
+
+			cfg, err := loadConfig()
+			if tt.pattern == "" {
+				if err == nil || !strings.Contains(err.Error(), "regular expression") {
+					t.Fatalf("err = %v, want an invalid regular expression", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := cfg.DynamicPattern.String(); got != tt.pattern {
+				t.Fatalf("pattern = %s, want %s", got, tt.pattern)
+			}
+		})
+	}
+}
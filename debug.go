@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+// debugPrefix marks the names answering with where a hostname's records come from
+const debugPrefix = "_autodns."
+
+// debugTarget returns the hostname a `_autodns.<hostname>` debug name is about.
+func debugTarget(name string) (string, bool) {
+	if len(name) <= len(debugPrefix) || !strings.EqualFold(name[:len(debugPrefix)], debugPrefix) {
+		return "", false
+	}
+	return name[len(debugPrefix):], true
+}
+
+// makeDebugResponse builds a TXT record per service of a hostname, describing the
+// container, network, Traefik instance and Docker host it was discovered from.
+func makeDebugResponse(h string, services []Service) *dns.Msg {
+	log.Debug().Msgf("Creating DNS debug response for: %s", h)
+
+	var records []dns.RR
+	for _, service := range services {
+		fields := []string{"container=" + service.ContainerName}
+		if service.Static {
+			fields = append(fields, "static=true")
+		}
+		if service.Network != "" {
+			fields = append(fields, "network="+service.Network)
+		}
+		if service.Via != "" {
+			fields = append(fields, "traefik="+service.Via)
+		}
+		if !service.Static {
+			fields = append(fields, "docker_host="+dockerHostName(service.DockerHost))
+		}
+		if service.CNAME != "" {
+			fields = append(fields, "cname="+service.CNAME)
+		} else {
+			fields = append(fields, "address="+service.addressString())
+		}
+
+		records = append(records, &dns.TXT{
+			Hdr: dns.RR_Header{
+				Name:   h,
+				Rrtype: dns.TypeTXT,
+				Class:  dns.ClassINET,
+				Ttl:    0,
+			},
+			Txt: fields,
+		})
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(&dns.Msg{})
+	m.Authoritative = true
+	m.RecursionAvailable = true
+	m.Answer = records
+
+	return m
+}
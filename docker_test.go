@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+)
+
+// fakeDocker serves the container list of a Docker daemon, returning its current
+// containers on each request, and makes it the only host discovered on.
+type fakeDocker struct {
+	mu         sync.Mutex
+	containers []container.Summary
+}
+
+func newFakeDocker(t *testing.T, containers ...container.Summary) *fakeDocker {
+	t.Helper()
+	d := &fakeDocker{containers: containers}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Api-Version", "1.47")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/_ping"):
+			w.Write([]byte("OK"))
+		case strings.HasSuffix(r.URL.Path, "/containers/json"):
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			json.NewEncoder(w).Encode(d.containers)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	config.DockerHosts = []string{"tcp://" + server.Listener.Addr().String()}
+	return d
+}
+
+// set replaces the daemon's containers.
+func (d *fakeDocker) set(containers ...container.Summary) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.containers = containers
+}
+
+// testContainer returns a running container with `labels`, at `ip` on each of `networks`.
+func testContainer(name, ip string, labels map[string]string, networks ...string) container.Summary {
+	c := container.Summary{
+		ID:              name + "0123456789abcdef",
+		Names:           []string{"/" + name},
+		Image:           "app:latest",
+		State:           "running",
+		Labels:          labels,
+		NetworkSettings: &container.NetworkSettingsSummary{Networks: map[string]*network.EndpointSettings{}},
+	}
+	for _, name := range networks {
+		c.NetworkSettings.Networks[name] = &network.EndpointSettings{NetworkID: name + "-id", IPAddress: ip}
+	}
+	return c
+}
+
+// testRegistry makes the global registry start empty for a test, restoring it afterwards.
+func testRegistry(t *testing.T) {
+	t.Helper()
+	previous := registry.Load()
+	registry.Store(nil)
+	t.Cleanup(func() { registry.Store(previous) })
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+// dohContentType is the media type of wire-format DNS messages (RFC 8484)
+const dohContentType = "application/dns-message"
+
+// dohWriter captures the response the DNS handler writes for a DoH request.
+type dohWriter struct {
+	local, remote net.Addr
+	msg           *dns.Msg
+}
+
+func (w *dohWriter) LocalAddr() net.Addr  { return w.local }
+func (w *dohWriter) RemoteAddr() net.Addr { return w.remote }
+func (w *dohWriter) Network() string      { return "https" }
+
+func (w *dohWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *dohWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(b), nil
+}
+
+func (w *dohWriter) Close() error        { return nil }
+func (w *dohWriter) TsigStatus() error   { return nil }
+func (w *dohWriter) TsigTimersOnly(bool) {}
+func (w *dohWriter) Hijack()             {}
+
+// dohHandler answers RFC 8484 queries, taken from the `dns` parameter of a GET or the
+// body of a POST, by running them through the same resolver as the DNS listeners.
+type dohHandler struct {
+	handler dns.Handler
+}
+
+func (h dohHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var packed []byte
+	switch r.Method {
+	case http.MethodGet:
+		var err error
+		packed, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		if err != nil || len(packed) == 0 {
+			http.Error(w, "missing or malformed `dns` parameter", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohContentType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		var err error
+		packed, err = io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize))
+		if err != nil {
+			http.Error(w, "failed to read body", http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := new(dns.Msg)
+	if err := req.Unpack(packed); err != nil {
+		http.Error(w, "malformed DNS message", http.StatusBadRequest)
+		return
+	}
+
+	// HTTP has no datagram size limit, so present the query as coming over TCP
+	remote, _ := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	writer := &dohWriter{local: &net.TCPAddr{}, remote: remote}
+	h.handler.ServeDNS(writer, req)
+	if writer.msg == nil {
+		http.Error(w, "no response", http.StatusInternalServerError)
+		return
+	}
+
+	resp, err := writer.msg.Pack()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to pack DoH response")
+		http.Error(w, "failed to pack response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", dohContentType)
+	w.Write(resp)
+}
+
+// serveDoH exposes DNS-over-HTTPS on `AUTODNS_DOH_ADDR` until `ctx` is cancelled. It
+// speaks plain HTTP when no certificate is configured, for use behind a TLS proxy.
+func serveDoH(ctx context.Context, certs *certReloader, handler dns.Handler) {
+	mux := http.NewServeMux()
+	mux.Handle("/dns-query", dohHandler{handler})
+
+	server := &http.Server{
+		Addr:              config.DoHAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	var err error
+	if certs != nil {
+		log.Info().Msgf("Serving DNS-over-HTTPS on `%s`", config.DoHAddr)
+		server.TLSConfig = &tls.Config{GetCertificate: certs.GetCertificate, MinVersion: tls.VersionTLS12}
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		log.Warn().Msgf("Serving DNS-over-HTTP without TLS on `%s`, as no certificate is configured", config.DoHAddr)
+		err = server.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Error().Err(err).Msgf("Failed to start DNS-over-HTTPS server on `%s`", config.DoHAddr)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dryRun discovers the services once and writes the records AutoDNS would serve to `w`
+// in zone file syntax, headed by the SOA and NS records when a domain is managed.
+func dryRun(w io.Writer) error {
+	services, err := discoverAll()
+	if err != nil {
+		return err
+	}
+	snapshot := newRegistry(services)
+	snapshot.serial = uint32(time.Now().Unix())
+
+	var records []dns.RR
+	if config.Domain != "" {
+		records = append(records, makeSOA(snapshot.Serial()), makeNS())
+	}
+	records = append(records, allRecords(snapshot, time.Now())...)
+
+	for _, record := range records {
+		if _, err := fmt.Fprintln(w, record.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// resolveDynamic synthesizes an IP address for names inside the configured dynamic zone,
+// in the style of nip.io: `ip-10-0-0-5.<zone>` resolves to `10.0.0.5`.
+// The second return value reports whether the name belongs to the dynamic zone at all;
+// names in the zone that don't encode a valid IPv4 address return a nil IP.
+func resolveDynamic(name string) (net.IP, bool) {
+	if config.DynamicZone == "" || !dns.IsSubDomain(config.DynamicZone, name) {
+		return nil, false
+	}
+
+	// Only match the labels in front of the zone, without the trailing dot
+	prefix := strings.TrimSuffix(strings.ToLower(name), config.DynamicZone)
+	prefix = strings.TrimSuffix(prefix, ".")
+
+	matches := config.DynamicPattern.FindStringSubmatchIndex(prefix)
+	if matches == nil {
+		return nil, true
+	}
+
+	expanded := config.DynamicPattern.ExpandString(nil, config.DynamicTemplate, prefix, matches)
+	ip := net.ParseIP(string(expanded)).To4()
+	if ip == nil {
+		return nil, true
+	}
+
+	return ip, true
+}
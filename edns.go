@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/hex"
+	"net"
+	"slices"
+
+	"github.com/miekg/dns"
+)
+
+// ednsUDPSize is the UDP buffer size advertised to EDNS0 clients, small enough to avoid
+// IP fragmentation on common paths.
+const ednsUDPSize = 1232
+
+// ednsWriter adds an OPT record to responses to queries that carried one, as EDNS0
+// expects, echoing the client's DO bit and Client Subnet option, and answering an NSID
+// request with `AUTODNS_NSID`. Answers are unsigned, and never marked as authenticated.
+type ednsWriter struct {
+	dns.ResponseWriter
+	opt *dns.OPT // The query's OPT record, nil if it sent none
+}
+
+func newEDNSWriter(w dns.ResponseWriter, r *dns.Msg) ednsWriter {
+	return ednsWriter{ResponseWriter: w, opt: r.IsEdns0()}
+}
+
+func (w ednsWriter) WriteMsg(m *dns.Msg) error {
+	// Forwarded answers already carry the upstream's OPT record
+	if w.opt != nil && m.IsEdns0() == nil {
+		m.SetEdns0(ednsUDPSize, w.opt.Do())
+		if subnet := clientSubnet(w.opt); subnet != nil {
+			m.IsEdns0().Option = append(m.IsEdns0().Option, subnetScope(subnet))
+		}
+	}
+
+	// Identify this instance, rather than the upstream, to clients asking which answered
+	if opt := m.IsEdns0(); opt != nil && w.opt != nil && config.NSID != "" && slices.ContainsFunc(w.opt.Option, isNSID) {
+		opt.Option = slices.DeleteFunc(opt.Option, isNSID)
+		opt.Option = append(opt.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: hex.EncodeToString([]byte(config.NSID))})
+	}
+
+	// Nothing is validated here, so don't vouch for the data, even an upstream's
+	m.AuthenticatedData = false
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// isNSID reports whether `option` is the EDNS0 name server identifier option (RFC 5001).
+func isNSID(option dns.EDNS0) bool {
+	return option.Option() == dns.EDNS0NSID
+}
+
+// clientSubnet returns the EDNS Client Subnet option (RFC 7871) of `opt`, nil if it has
+// none. Forwarding resolvers set it to the subnet of the client they ask for.
+func clientSubnet(opt *dns.OPT) *dns.EDNS0_SUBNET {
+	for _, option := range opt.Option {
+		if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+			return subnet
+		}
+	}
+	return nil
+}
+
+// subnetClient returns the client address answers to `r` are ordered for: the subnet
+// of its Client Subnet option if it reveals one, else the `peer` that sent it.
+func subnetClient(r *dns.Msg, peer net.IP) net.IP {
+	if peer == nil {
+		return nil // Not asked by a client
+	}
+	if opt := r.IsEdns0(); opt != nil {
+		if subnet := clientSubnet(opt); subnet != nil && subnet.SourceNetmask > 0 && subnet.Address != nil {
+			return subnet.Address
+		}
+	}
+	return peer
+}
+
+// subnetScope echoes the query's Client Subnet option, scoped to its whole source
+// prefix if answers are ordered by client, so resolvers caching them keep one per
+// subnet, or to none otherwise.
+func subnetScope(subnet *dns.EDNS0_SUBNET) *dns.EDNS0_SUBNET {
+	echo := *subnet
+	echo.SourceScope = 0
+	if config.Order == "affinity" || config.Order == "proximity" {
+		echo.SourceScope = subnet.SourceNetmask
+	}
+	return &echo
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+// preferredUpstream is the index of the upstream that last answered, tried first so
+// a dead resolver at the head of the list doesn't delay every query.
+var preferredUpstream atomic.Int64
+
+// upstreamClient returns a client forwarding over `network`, "udp" or "tcp", sent from
+// `AUTODNS_UPSTREAM_SOURCE_IP` if set.
+func upstreamClient(network string) *dns.Client {
+	c := &dns.Client{
+		Net:     network,
+		Timeout: config.UpstreamTimeout,
+	}
+	if ip := net.ParseIP(config.UpstreamSourceIP); ip != nil {
+		c.Dialer = &net.Dialer{Timeout: config.UpstreamTimeout, LocalAddr: &net.UDPAddr{IP: ip}}
+		if network == "tcp" {
+			c.Dialer.LocalAddr = &net.TCPAddr{IP: ip}
+		}
+	}
+	return c
+}
+
+// forwardQuery relays `r` to the configured upstream resolvers in turn, starting with
+// the one that last answered, and writes the first answer back to the client. Answers
+// truncated over UDP are fetched again over TCP from the same upstream. It returns
+// SERVFAIL only if every upstream fails or times out.
+func forwardQuery(w dns.ResponseWriter, r *dns.Msg) {
+	name := r.Question[0].Name
+
+	if upstreamCache != nil {
+		if resp := upstreamCache.Get(r, time.Now()); resp != nil {
+			if err := w.WriteMsg(resp); err != nil {
+				log.Error().Err(err).Msgf("Failed to write cached DNS response for %s", name)
+				return
+			}
+			log.Info().Msgf("DNS response for %s served from cache: %s", name, dns.RcodeToString[resp.Rcode])
+			return
+		}
+	}
+
+	c, tcp := upstreamClient("udp"), upstreamClient("tcp")
+
+	first := int(preferredUpstream.Load())
+	for i := range config.Upstream {
+		index := (first + i) % len(config.Upstream)
+		upstream := config.Upstream[index]
+
+		resp, rtt, err := c.Exchange(r, upstream)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Failed to forward query for %s to upstream `%s`", name, upstream)
+			continue
+		}
+
+		// Fetch the whole answer over TCP rather than relaying a truncated one
+		if resp.Truncated {
+			log.Debug().Msgf("Upstream `%s` truncated the answer for %s, retrying over TCP", upstream, name)
+			tcpResp, tcpRTT, err := tcp.Exchange(r, upstream)
+			if err != nil {
+				log.Warn().Err(err).Msgf("Failed to forward query for %s to upstream `%s` over TCP", name, upstream)
+				continue
+			}
+			resp, rtt = tcpResp, rtt+tcpRTT
+		}
+		preferredUpstream.Store(int64(index))
+
+		upstreamDuration.Observe(rtt.Seconds())
+
+		// Whoever answered, the name isn't in a zone we own
+		resp.Authoritative = false
+		if upstreamCache != nil {
+			upstreamCache.Put(r, resp, time.Now())
+		}
+
+		// Relay the upstream answer as-is, under the client's query ID
+		resp.Id = r.Id
+		if err := w.WriteMsg(resp); err != nil {
+			log.Error().Err(err).Msgf("Failed to write forwarded DNS response for %s", name)
+			return
+		}
+		log.Info().Msgf("DNS response forwarded for %s from `%s` in %s: %s", name, upstream, rtt, dns.RcodeToString[resp.Rcode])
+		return
+	}
+
+	log.Error().Msgf("All %d upstreams failed for %s, answering SERVFAIL", len(config.Upstream), name)
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeServerFailure)
+	w.WriteMsg(m)
+}
+
+// upstreamIsSelf reports whether `upstream` points back at our own listener on
+// `listen`, which would make every forwarded query loop forever.
+func upstreamIsSelf(upstream, listen string) bool {
+	upstreamHost, upstreamPort, err := net.SplitHostPort(upstream)
+	if err != nil {
+		return false
+	}
+	listenHost, listenPort, err := net.SplitHostPort(listen)
+	if err != nil || upstreamPort != listenPort {
+		return false
+	}
+
+	ips, err := net.LookupIP(upstreamHost)
+	if err != nil {
+		return false
+	}
+
+	for _, ip := range ips {
+		// A specific listen address only loops back onto itself
+		if listenHost != "" {
+			if ip.Equal(net.ParseIP(listenHost)) {
+				return true
+			}
+			continue
+		}
+
+		// A wildcard listen address catches loopback and every local interface
+		if ip.IsLoopback() || ip.IsUnspecified() || isLocalAddress(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLocalAddress reports whether `ip` is assigned to one of this host's interfaces.
+func isLocalAddress(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+
+	for _, addr := range addrs {
+		if network, ok := addr.(*net.IPNet); ok && network.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
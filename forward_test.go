@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startUpstream serves `handler` over UDP and TCP on a free local port, returning its
+// address.
+func startUpstream(t *testing.T, handler dns.HandlerFunc) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		t.Fatal(err)
+	}
+
+	for _, server := range []*dns.Server{{PacketConn: pc, Handler: handler}, {Listener: l, Handler: handler}} {
+		started := make(chan struct{})
+		server.NotifyStartedFunc = func() { close(started) }
+		go server.ActivateAndServe()
+		<-started
+		t.Cleanup(func() { server.Shutdown() })
+	}
+	return pc.LocalAddr().String()
+}
+
+// answerA answers every query with a single A record.
+func answerA(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN A 192.0.2.1")
+	m.Answer = []dns.RR{rr}
+	w.WriteMsg(m)
+}
+
+func TestForwardQueryCache(t *testing.T) {
+	testConfig(t)
+	var queries atomic.Int32
+	config.Upstream = []string{startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		answerA(w, r)
+	})}
+
+	previous := upstreamCache
+	upstreamCache = newResponseCache(8)
+	t.Cleanup(func() { upstreamCache = previous })
+
+	for i := range 3 {
+		r := new(dns.Msg)
+		r.SetQuestion("example.org.", dns.TypeA)
+		w := newRecordingWriter("udp")
+		forwardQuery(w, r)
+		if len(w.msgs) != 1 || len(w.msgs[0].Answer) != 1 {
+			t.Fatalf("query %d got %v, want a single answer", i, w.msgs)
+		}
+		if w.msgs[0].Id != r.Id {
+			t.Errorf("query %d answered with ID %d, want %d", i, w.msgs[0].Id, r.Id)
+		}
+	}
+	if n := queries.Load(); n != 1 {
+		t.Fatalf("upstream got %d queries, want 1", n)
+	}
+}
+
+func TestUpstreamClientSourceIP(t *testing.T) {
+	tests := []struct {
+		name     string
+		sourceIP string
+		network  string
+		want     net.Addr
+	}{
+		{"unset over UDP", "", "udp", nil},
+		{"unset over TCP", "", "tcp", nil},
+		{"IPv4 over UDP", "192.0.2.1", "udp", &net.UDPAddr{IP: net.ParseIP("192.0.2.1")}},
+		{"IPv4 over TCP", "192.0.2.1", "tcp", &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}},
+		{"IPv6 over UDP", "2001:db8::1", "udp", &net.UDPAddr{IP: net.ParseIP("2001:db8::1")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testConfig(t)
+			config.UpstreamSourceIP = tt.sourceIP
+
+			c := upstreamClient(tt.network)
+			if c.Net != tt.network {
+				t.Errorf("network = %s, want %s", c.Net, tt.network)
+			}
+			var got net.Addr
+			if c.Dialer != nil {
+				got = c.Dialer.LocalAddr
+			}
+			if fmt.Sprintf("%#v", got) != fmt.Sprintf("%#v", tt.want) {
+				t.Fatalf("local address = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardQuerySourceIP(t *testing.T) {
+	testConfig(t)
+	config.UpstreamSourceIP = "127.0.0.2" // Any loopback address is local on Linux
+
+	sources := make(chan string, 1)
+	config.Upstream = []string{startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		sources <- clientIP(w.RemoteAddr()).String()
+		answerA(w, r)
+	})}
+
+	r := new(dns.Msg)
+	r.SetQuestion("example.org.", dns.TypeA)
+	forwardQuery(newRecordingWriter("udp"), r)
+	if got := <-sources; got != config.UpstreamSourceIP {
+		t.Fatalf("upstream got the query from %s, want %s", got, config.UpstreamSourceIP)
+	}
+}
+
+// closedAddr returns a local UDP address nothing listens on.
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := pc.LocalAddr().String()
+	pc.Close()
+	return addr
+}
+
+func TestForwardQueryFailover(t *testing.T) {
+	tests := []struct {
+		name      string
+		upstreams []string // "answer", "silent" never answering, or "closed"
+		rcode     int
+		preferred int64 // The upstream tried first afterwards
+	}{
+		{"first answers", []string{"answer", "answer"}, dns.RcodeSuccess, 0},
+		{"first times out", []string{"silent", "answer"}, dns.RcodeSuccess, 1},
+		{"first refuses connections", []string{"closed", "answer"}, dns.RcodeSuccess, 1},
+		{"third answers", []string{"closed", "silent", "answer"}, dns.RcodeSuccess, 2},
+		{"all fail", []string{"silent", "closed"}, dns.RcodeServerFailure, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testConfig(t)
+			config.UpstreamTimeout = 200 * time.Millisecond
+			previous := preferredUpstream.Load()
+			preferredUpstream.Store(0)
+			t.Cleanup(func() { preferredUpstream.Store(previous) })
+
+			queries := make([]atomic.Int32, len(tt.upstreams))
+			config.Upstream = nil
+			for i, kind := range tt.upstreams {
+				var addr string
+				switch kind {
+				case "answer":
+					addr = startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+						queries[i].Add(1)
+						answerA(w, r)
+					})
+				case "silent":
+					addr = startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) { queries[i].Add(1) })
+				case "closed":
+					addr = closedAddr(t)
+				}
+				config.Upstream = append(config.Upstream, addr)
+			}
+
+			for round := range 2 {
+				r := new(dns.Msg)
+				r.SetQuestion("example.org.", dns.TypeA)
+				w := newRecordingWriter("udp")
+				forwardQuery(w, r)
+				if len(w.msgs) != 1 || w.msgs[0].Rcode != tt.rcode {
+					t.Fatalf("round %d got %v, want a single %s answer", round, w.msgs, dns.RcodeToString[tt.rcode])
+				}
+				if got := preferredUpstream.Load(); got != tt.preferred {
+					t.Fatalf("round %d preferred upstream %d, want %d", round, got, tt.preferred)
+				}
+			}
+
+			// Once one answered, the failed ones before it are skipped
+			if tt.rcode == dns.RcodeSuccess {
+				for i := range tt.upstreams {
+					want := int32(0)
+					if int64(i) == tt.preferred {
+						want = 2
+					} else if tt.upstreams[i] == "silent" {
+						want = 1
+					}
+					if got := queries[i].Load(); tt.upstreams[i] != "closed" && got != want {
+						t.Errorf("upstream %d (%s) got %d queries, want %d", i, tt.upstreams[i], got, want)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// listeningUDP and listeningTCP are set once the respective DNS server accepts queries.
+var listeningUDP, listeningTCP atomic.Bool
+
+// healthStatus is the JSON body of the health endpoints.
+type healthStatus struct {
+	Status   string `json:"status"`
+	Services int    `json:"services"`
+}
+
+// writeHealth answers a probe with 200 if `ok` and 503 otherwise.
+func writeHealth(w http.ResponseWriter, ok bool) {
+	status := healthStatus{Status: "ok"}
+	if snapshot := registry.Load(); snapshot != nil {
+		status.Services = snapshot.Len()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		status.Status = "unavailable"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+// serveHealth exposes liveness and readiness probes on `AUTODNS_HEALTH_ADDR` until `ctx`
+// is cancelled. `/healthz` succeeds once both DNS servers are listening, `/readyz` once
+// the first discovery has also succeeded, which requires reaching Docker.
+func serveHealth(ctx context.Context) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, listeningUDP.Load() && listeningTCP.Load())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, listeningUDP.Load() && listeningTCP.Load() && discoveredOnce.Load())
+	})
+	mux.HandleFunc("/services", handleServices)
+
+	server := &http.Server{
+		Addr:              config.HealthAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	log.Info().Msgf("Serving health checks on `%s`", config.HealthAddr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Error().Err(err).Msgf("Failed to start health server on `%s`", config.HealthAddr)
+	}
+}
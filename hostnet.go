@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net"
+	"sync"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/rs/zerolog/log"
+)
+
+// isHostNetwork reports whether the container shares the Docker host's network stack
+// (`--network host`), and so has no address of its own.
+func isHostNetwork(container container.Summary) bool {
+	return container.HostConfig.NetworkMode == "host"
+}
+
+// hostIP returns the address host-network containers resolve to: `AUTODNS_HOST_IP`, or
+// else the address of the default route, detected once. It returns nil if neither is known.
+var hostIP = sync.OnceValue(func() net.IP {
+	if config.HostIP != "" {
+		return net.ParseIP(config.HostIP) // Validated by loadConfig
+	}
+
+	// Connecting a UDP socket picks the outgoing address without sending anything
+	conn, err := net.Dial("udp", "192.0.2.1:53")
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to detect the host IP for host-network containers, set `AUTODNS_HOST_IP`")
+		return nil
+	}
+	defer conn.Close()
+	ip := conn.LocalAddr().(*net.UDPAddr).IP
+	log.Info().Msgf("Detected host IP `%s` for host-network containers", ip)
+	return ip
+})
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/rs/zerolog/log"
+)
+
+// hostsFileServices holds the hosts last read from `AUTODNS_HOSTS_FILE`.
+var hostsFileServices atomic.Pointer[[]Service]
+
+// loadHostsFile parses `AUTODNS_HOSTS_FILE` and keeps its hosts for the following
+// discovery runs. On failure, the hosts read before stay in place.
+func loadHostsFile() error {
+	services, err := parseHostsFile(config.HostsFile)
+	if err != nil {
+		return err
+	}
+	log.Info().Msgf("Loaded %d hosts from hosts file `%s`", len(services), config.HostsFile)
+	hostsFileServices.Store(&services)
+	return nil
+}
+
+// parseHostsFile reads a file in `/etc/hosts` format, an IP address then one or more
+// hostnames per line, into static services. Single-label names are put under
+// `AUTODNS_DOMAIN` and `#` starts a comment.
+func parseHostsFile(path string) ([]Service, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open hosts file: %w", err)
+	}
+	defer file.Close()
+
+	var services []Service
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+
+		ip := net.ParseIP(fields[0])
+		if ip == nil || len(fields) < 2 {
+			log.Warn().Msgf("Hosts file `%s` has an invalid entry on line %d, skipping", path, line)
+			continue
+		}
+		for _, name := range fields[1:] {
+			hostname := qualifyHostname(name)
+			if !validHostname(hostname) {
+				log.Warn().Msgf("Hosts file `%s` has an invalid hostname %q on line %d, skipping", path, name, line)
+				continue
+			}
+			service := Service{ContainerName: "hostsfile", HostnameLabel: hostname, RecordTTL: config.TTL, Static: true}
+			service.setAddress(ip)
+			services = append(services, service)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read hosts file `%s`: %w", path, err)
+	}
+	return services, nil
+}
+
+// mergeHostsFile adds the hosts file's entries to `services`, leaving out the names
+// `services` already holds.
+func mergeHostsFile(services []Service) []Service {
+	hosts := hostsFileServices.Load()
+	if hosts == nil {
+		return services
+	}
+
+	known := make(map[string]bool, len(services))
+	for _, service := range services {
+		known[service.HostnameLabel] = true
+	}
+	for _, service := range *hosts {
+		if known[service.HostnameLabel] {
+			log.Debug().Msgf("Hosts file entry `%s` is overridden by a discovered service", service.HostnameLabel)
+			continue
+		}
+		services = append(services, service)
+	}
+	return services
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// labelConfig is the JSON object of a container's `com.autodns.config` label, e.g.
+// `{"hostname":"app.local","ttl":60,"ips":["10.0.0.5"],"type":"A"}`. Set fields
+// override the matching individual labels.
+type labelConfig struct {
+	Hostname string   `json:"hostname"` // Like `com.autodns.hostname`, comma-separated for several
+	TTL      *uint32  `json:"ttl"`      // Like `com.autodns.ttl`
+	Weight   *uint16  `json:"weight"`   // Like `com.autodns.weight`
+	Network  string   `json:"network"`  // Like `com.autodns.network`
+	IPs      []string `json:"ips"`      // At most one IPv4 and one IPv6 address
+	Type     string   `json:"type"`     // `A` or `AAAA` to serve a single family, or `CNAME`
+	Target   string   `json:"target"`   // The CNAME target, with `"type":"CNAME"`
+
+	ips []net.IP
+}
+
+// parseLabelConfig parses and checks the JSON of a `com.autodns.config` label.
+func parseLabelConfig(value string) (*labelConfig, error) {
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.DisallowUnknownFields()
+
+	var cfg labelConfig
+	if err := decoder.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+	if decoder.More() {
+		return nil, errors.New("invalid JSON: trailing data after the object")
+	}
+
+	cfg.Type = strings.ToUpper(cfg.Type)
+	switch cfg.Type {
+	case "", "A", "AAAA":
+		if cfg.Target != "" {
+			return nil, errors.New(`"target" needs "type":"CNAME"`)
+		}
+	case "CNAME":
+		if cfg.Target == "" {
+			return nil, errors.New(`"type":"CNAME" needs a "target"`)
+		}
+		if len(cfg.IPs) > 0 {
+			return nil, errors.New(`"ips" cannot be set with "type":"CNAME"`)
+		}
+	default:
+		return nil, fmt.Errorf("unknown type %q, expected A, AAAA or CNAME", cfg.Type)
+	}
+
+	families := make(map[bool]bool) // Whether an IPv4 or IPv6 address was seen
+	for _, value := range cfg.IPs {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %q", value)
+		}
+		is4 := ip.To4() != nil
+		if families[is4] {
+			return nil, fmt.Errorf(`"ips" holds more than one address of the family of %q`, value)
+		}
+		families[is4] = true
+		cfg.ips = append(cfg.ips, ip)
+	}
+	if cfg.Weight != nil && *cfg.Weight == 0 {
+		return nil, errors.New(`"weight" must be positive`)
+	}
+	return &cfg, nil
+}
+
+// expandLabelConfig returns the container with the fields of its `com.autodns.config`
+// label written over the individual labels they replace, and the parsed config, nil
+// if the container has none.
+func expandLabelConfig(c container.Summary) (container.Summary, *labelConfig, error) {
+	value, ok := c.Labels[labelKey("config")]
+	if !ok || strings.TrimSpace(value) == "" {
+		return c, nil, nil
+	}
+	cfg, err := parseLabelConfig(value)
+	if err != nil {
+		return c, nil, err
+	}
+
+	// The Docker summary is shared with the rest of the discovery run
+	c.Labels = maps.Clone(c.Labels)
+	set := func(name, value string) {
+		if value != "" {
+			c.Labels[labelKey(name)] = value
+		}
+	}
+	set("hostname", cfg.Hostname)
+	set("network", cfg.Network)
+	set("cname", cfg.Target)
+	if cfg.TTL != nil {
+		set("ttl", strconv.FormatUint(uint64(*cfg.TTL), 10))
+	}
+	if cfg.Weight != nil {
+		set("weight", strconv.FormatUint(uint64(*cfg.Weight), 10))
+	}
+	if len(cfg.ips) > 0 {
+		// The rest of the addresses are set by apply once discovered
+		set("ip", cfg.ips[0].String())
+		delete(c.Labels, labelKey("cname"))
+	}
+	return c, cfg, nil
+}
+
+// apply sets the config's addresses on the container's discovered services, and drops
+// the address family its type leaves out. Services left without an address are dropped.
+func (c *labelConfig) apply(services []Service) []Service {
+	if c == nil {
+		return services
+	}
+
+	var kept []Service
+	for _, service := range services {
+		if service.CNAME != "" {
+			kept = append(kept, service)
+			continue
+		}
+		if len(c.ips) > 0 {
+			service.IPAddress, service.IPAddress6 = nil, nil
+			for _, ip := range c.ips {
+				service.setAddress(ip)
+			}
+		}
+		switch c.Type {
+		case "A":
+			service.IPAddress6 = nil
+		case "AAAA":
+			service.IPAddress = nil
+		}
+		if service.IPAddress == nil && service.IPAddress6 == nil {
+			continue
+		}
+		kept = append(kept, service)
+	}
+	return kept
+}
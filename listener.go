@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Binding is retried, as a previous instance may still hold the port while restarting
+const (
+	bindAttempts   = 5
+	bindRetryDelay = time.Second
+)
+
+// listenWithRetry calls `listen` until it succeeds, giving up after `bindAttempts`
+// failures spaced `bindRetryDelay` apart, or when `ctx` is cancelled.
+func listenWithRetry[T any](ctx context.Context, what, addr string, listen func() (T, error)) (T, error) {
+	for attempt := 1; ; attempt++ {
+		l, err := listen()
+		if err == nil {
+			return l, nil
+		}
+		if attempt == bindAttempts {
+			return l, fmt.Errorf("failed to bind %s on `%s` after %d attempts: %w", what, addr, attempt, err)
+		}
+		log.Warn().Err(err).Msgf("Failed to bind %s on `%s` (attempt %d of %d), retrying in %s", what, addr, attempt, bindAttempts, bindRetryDelay)
+
+		select {
+		case <-ctx.Done():
+			return l, ctx.Err()
+		case <-time.After(bindRetryDelay):
+		}
+	}
+}
+
+// listenUnix listens on the Unix socket at `path`, first removing a socket left behind
+// by an instance that didn't shut down cleanly. The socket file is removed again when
+// the listener is closed.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket `%s`: %w", path, err)
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// limitListener wraps a TCP listener and closes incoming connections beyond `max`
+// concurrently open ones, so idle clients can't exhaust the server.
+type limitListener struct {
+	net.Listener
+	max      int64
+	active   atomic.Int64
+	rejected atomic.Int64
+
+	mu       sync.Mutex
+	unlogged int // Connections rejected since the last log line
+	loggedAt time.Time
+}
+
+func newLimitListener(l net.Listener, max int) *limitListener {
+	return &limitListener{Listener: l, max: int64(max)}
+}
+
+// Accept waits for the next connection within the limit, rejecting any in excess of it.
+// Rejections are logged at most once a minute, with how many there were.
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if l.active.Add(1) > l.max {
+			l.active.Add(-1)
+			l.reject(conn)
+			continue
+		}
+
+		return &limitConn{Conn: conn, release: func() { l.active.Add(-1) }}, nil
+	}
+}
+
+// reject closes `conn`, logging it unless a rejection was logged within the last minute.
+func (l *limitListener) reject(conn net.Conn) {
+	defer conn.Close()
+	l.rejected.Add(1)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.unlogged++
+	if now := time.Now(); now.Sub(l.loggedAt) > time.Minute {
+		log.Warn().Msgf("Rejecting TCP connection from %s: limit of %d connections reached (%d connections rejected)", conn.RemoteAddr(), l.max, l.unlogged)
+		l.loggedAt = now
+		l.unlogged = 0
+	}
+}
+
+// Active returns the number of currently open connections.
+func (l *limitListener) Active() int64 {
+	return l.active.Load()
+}
+
+// Rejected returns the number of connections rejected so far.
+func (l *limitListener) Rejected() int64 {
+	return l.rejected.Load()
+}
+
+// limitConn releases its slot in the listener exactly once when closed.
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
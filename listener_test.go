@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func TestLimitListener(t *testing.T) {
+	var logged bytes.Buffer
+	previous := log.Logger
+	log.Logger = zerolog.New(&logged)
+	t.Cleanup(func() { log.Logger = previous })
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newLimitListener(inner, 2)
+	t.Cleanup(func() { l.Close() })
+
+	accepted := make(chan net.Conn, 8)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	// The first two connections are kept open, the next ones closed right away
+	var open []net.Conn
+	for range 2 {
+		dial()
+		open = append(open, <-accepted)
+	}
+	for range 5 {
+		conn := dial()
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("read from a connection over the limit: %v, want EOF", err)
+		}
+	}
+	if active, rejected := l.Active(), l.Rejected(); active != 2 || rejected != 5 {
+		t.Errorf("active = %d, rejected = %d, want 2 and 5", active, rejected)
+	}
+	if lines := strings.Count(logged.String(), "Rejecting TCP connection"); lines != 1 {
+		t.Errorf("logged %d rejections, want a single line for the burst", lines)
+	}
+
+	// Closing a connection frees its slot
+	open[0].Close()
+	dial()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection not accepted after a slot was freed")
+	}
+}
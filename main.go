@@ -1,64 +1,456 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"math/rand/v2"
 	"net"
 	"os"
-	"regexp"
+	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	// DNS server
 	"github.com/miekg/dns"
 
 	// Docker client
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
 
+	// Internationalized hostnames
+	"golang.org/x/net/idna"
+
 	// Logging
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
-func makeResponse(h string, ip net.IP) *dns.Msg {
+// defaultTTL is the TTL, in seconds, of served records unless `AUTODNS_TTL` says otherwise
+const defaultTTL = 3600
+
+// makeResponse builds an A record for each IPv4 address and an AAAA record for each IPv6 one.
+// The AA bit is set only if `authoritative`, i.e. `h` is within a zone we own.
+func makeResponse(h string, ips []net.IP, ttl uint32, authoritative bool) *dns.Msg {
 	log.Debug().Msgf("Creating DNS response for: %s", h)
 
+	records := make([]dns.RR, 0, len(ips))
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			records = append(records, &dns.A{
+				Hdr: dns.RR_Header{
+					Name:   h,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    ttl,
+				},
+				A: ip4,
+			})
+		} else {
+			records = append(records, &dns.AAAA{
+				Hdr: dns.RR_Header{
+					Name:   h,
+					Rrtype: dns.TypeAAAA,
+					Class:  dns.ClassINET,
+					Ttl:    ttl,
+				},
+				AAAA: ip,
+			})
+		}
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(&dns.Msg{})
+	m.Authoritative = authoritative
+	m.RecursionAvailable = true
+	m.Answer = records
+
+	return m
+}
+
+// makeSRVResponse answers with the SRV records of services that haven't expired, each
+// with the TTL of the service publishing it.
+func makeSRVResponse(h string, records []SRVRecord, now time.Time) *dns.Msg {
+	log.Debug().Msgf("Creating DNS SRV response for: %s", h)
+
+	answers := make([]dns.RR, 0, len(records))
+	for _, record := range records {
+		owner := record.owner()
+		if owner.Expired(now) {
+			continue
+		}
+		answers = append(answers, &dns.SRV{
+			Hdr: dns.RR_Header{
+				Name:   h,
+				Rrtype: dns.TypeSRV,
+				Class:  dns.ClassINET,
+				Ttl:    owner.TTL(now),
+			},
+			Priority: record.Priority,
+			Weight:   record.Weight,
+			Port:     record.Port,
+			Target:   record.Target,
+		})
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(&dns.Msg{})
+	m.Authoritative = true
+	m.RecursionAvailable = true
+	m.Answer = answers
+
+	return m
+}
+
+// makeCNAMEResponse builds a CNAME record pointing `h` at `target`. For address queries
+// it follows the alias through to the target's record when it is one of ours. The AA
+// bit is set only if `h` is within a zone we own.
+func makeCNAMEResponse(h string, target string, ttl uint32, qtype uint16, snapshot *Registry) *dns.Msg {
+	log.Debug().Msgf("Creating DNS CNAME response for: %s -> %s", h, target)
+
 	records := []dns.RR{
-		&dns.A{
+		&dns.CNAME{
 			Hdr: dns.RR_Header{
 				Name:   h,
-				Rrtype: dns.TypeA,
+				Rrtype: dns.TypeCNAME,
 				Class:  dns.ClassINET,
-				Ttl:    3600,
+				Ttl:    ttl,
 			},
-			A: ip,
+			Target: target,
 		},
 	}
 
+	if qtype == dns.TypeA || qtype == dns.TypeAAAA {
+		if services, ok := snapshot.Lookup(target); ok && services[0].CNAME == "" {
+			if ips, targetTTL := addresses(services, qtype, time.Now(), nil); len(ips) > 0 {
+				records = append(records, makeResponse(target, capAnswers(ips), targetTTL, true).Answer...)
+			}
+		}
+	}
+
 	m := new(dns.Msg)
 	m.SetReply(&dns.Msg{})
-	m.Authoritative = true
+	m.Authoritative = ownsName(h, snapshot)
 	m.RecursionAvailable = true
-	m.Compress = false
 	m.Answer = records
 
 	return m
 }
 
+// makeNegativeResponse answers a query that has no matching records. Names we hold no
+// records for at all get NXDOMAIN; names that exist but lack the requested type get
+// an empty NOERROR (NODATA) answer.
+func makeNegativeResponse(r *dns.Msg, snapshot *Registry, name string) *dns.Msg {
+	m := new(dns.Msg)
+	if snapshot.Exists(name) || name == zoneName() {
+		m.SetReply(r)
+	} else {
+		m.SetRcode(r, dns.RcodeNameError)
+	}
+	m.Authoritative = true
+	return addSOA(m, name, snapshot)
+}
+
 type Service struct {
 	ContainerName string
 	HostnameLabel string
 	IPAddress     net.IP
+	IPAddress6    net.IP // Optional IPv6 address, served for AAAA queries
+	CNAME         string // Alias target from `com.autodns.cname`; such services have no address
+	SRV           []SRVRecord
+	TXT           []string   // Values from `com.autodns.txt`, one TXT record each
+	MX            []MXRecord // Mail exchangers from `com.autodns.mx`
+	Records       []dns.RR   // Verbatim records from `com.autodns.record`, named `.` until served
+	RecordTTL     uint32     // TTL from `com.autodns.ttl`, or the global `AUTODNS_TTL`
+	Weight        uint       // Round-robin weight from `com.autodns.weight`; 0 counts as 1
+	ExpiresAt     time.Time  // Zero if the service never expires
+	LeaseEnd      time.Time  // Zero if the container has no expected lifetime
+	Static        bool       // Configured statically rather than discovered from Docker
+	DockerHost    string     // Docker daemon the service was discovered on, "" for the local one
+	Network       string     // Docker network the address was taken from, "" if set by label
+	Via           string     // Traefik container the service is routed through, "" if reached directly
+	NetworkAlias  bool       // Named after a Docker network alias; labelled names win over it
+}
+
+// AddressFor returns the address to serve for an A or AAAA query, or nil if the
+// service has no address of that family.
+func (s Service) AddressFor(qtype uint16) net.IP {
+	if qtype == dns.TypeAAAA {
+		return s.IPAddress6
+	}
+	return s.IPAddress
+}
+
+// setAddress stores `ip` as the IPv4 or IPv6 address depending on its family.
+func (s *Service) setAddress(ip net.IP) {
+	if ip.To4() != nil {
+		s.IPAddress = ip
+	} else {
+		s.IPAddress6 = ip
+	}
+}
+
+// addressString formats the service's addresses for logging.
+func (s Service) addressString() string {
+	if s.IPAddress6 != nil {
+		return fmt.Sprintf("%s, %s", s.IPAddress, s.IPAddress6)
+	}
+	return s.IPAddress.String()
+}
+
+// Expired reports whether the service has passed its `com.autodns.expires_at` time.
+func (s Service) Expired(now time.Time) bool {
+	return !s.ExpiresAt.IsZero() && !now.Before(s.ExpiresAt)
+}
+
+// TTL returns the TTL to serve for the service, never outliving its expiry.
+// It is also capped to the container's remaining lifetime, but no lower than `AUTODNS_MIN_TTL`.
+func (s Service) TTL(now time.Time) uint32 {
+	return min(s.RecordTTL, s.Lifetime(now))
+}
+
+// Lifetime returns the longest TTL the service's lease and expiry allow, or
+// math.MaxUint32 if it has neither.
+func (s Service) Lifetime(now time.Time) uint32 {
+	lifetime := uint32(math.MaxUint32)
+	if !s.LeaseEnd.IsZero() {
+		remaining := uint32(max(s.LeaseEnd.Sub(now).Seconds(), 0))
+		lifetime = min(lifetime, max(remaining, config.MinTTL))
+	}
+	if !s.ExpiresAt.IsZero() {
+		remaining := uint32(max(s.ExpiresAt.Sub(now).Seconds(), 0))
+		lifetime = min(lifetime, remaining)
+	}
+	return lifetime
+}
+
+// lifetime returns the shortest lifetime among the live services.
+func lifetime(services []Service, now time.Time) uint32 {
+	shortest := uint32(math.MaxUint32)
+	for _, service := range services {
+		if !service.Expired(now) {
+			shortest = min(shortest, service.Lifetime(now))
+		}
+	}
+	return shortest
+}
+
+// jitterTTL moves `ttl` randomly within `AUTODNS_TTL_JITTER` percent of itself, so
+// records served with the same TTL don't all expire from caches at once. It never
+// exceeds `limit`, the records' remaining lifetime, and a TTL of 0 stays 0.
+func jitterTTL(ttl, limit uint32) uint32 {
+	if config.TTLJitter == 0 || ttl == 0 {
+		return ttl
+	}
+	spread := float64(ttl) * float64(config.TTLJitter) / 100
+	jittered := math.Round(float64(ttl) + (2*rand.Float64()-1)*spread)
+	return min(uint32(min(max(jittered, 1), math.MaxInt32)), limit)
+}
+
+// liveServices returns the services that haven't expired yet.
+func liveServices(services []Service, now time.Time) []Service {
+	live := make([]Service, 0, len(services))
+	for _, service := range services {
+		if !service.Expired(now) {
+			live = append(live, service)
+		}
+	}
+	return live
+}
+
+// anyLive reports whether any of the services hasn't expired yet, without copying them.
+func anyLive(services []Service, now time.Time) bool {
+	return slices.ContainsFunc(services, func(service Service) bool { return !service.Expired(now) })
+}
+
+// addresses collects the addresses of `services` for an A or AAAA query, along with
+// the lowest TTL among them, so no record outlives the shortest-lived service.
+// The addresses are ordered for `client` by `AUTODNS_ORDER`, e.g. shuffled by weight for
+// basic load spreading.
+func addresses(services []Service, qtype uint16, now time.Time, client net.IP) ([]net.IP, uint32) {
+	// Sized for the common case of every service having an address, on every query
+	ips := make([]net.IP, 0, len(services))
+	weights := make([]uint, 0, len(services))
+	ttl := uint32(math.MaxUint32)
+	for i := range services {
+		service := &services[i]
+		if service.Expired(now) {
+			continue
+		}
+		if ip := service.AddressFor(qtype); ip != nil {
+			ips = append(ips, ip)
+			weights = append(weights, max(service.Weight, 1))
+			ttl = min(ttl, service.TTL(now))
+		}
+	}
+
+	if len(services) > 0 {
+		// The services of a name all share its hostname
+		answerOrders[config.Order].Order(dns.Fqdn(services[0].HostnameLabel), ips, weights, client)
+	}
+	return ips, ttl
+}
+
+// answerRotation advances the subset of addresses served under `AUTODNS_MAX_ANSWERS`
+// when `AUTODNS_ORDER` keeps them in a fixed order.
+var answerRotation atomic.Uint64
+
+// capAnswers limits `ips` to `AUTODNS_MAX_ANSWERS`, serving a different subset on each
+// query so every backend still gets its share of traffic.
+func capAnswers(ips []net.IP) []net.IP {
+	limit := config.MaxAnswers
+	if limit <= 0 || len(ips) <= limit {
+		return ips
+	}
+
+	// Shuffled addresses already differ on every query, a fixed order is rotated instead
+	if config.Order == "stable" {
+		start := int(answerRotation.Add(1) % uint64(len(ips)))
+		ips = slices.Concat(ips[start:], ips[:start])
+	}
+	return ips[:limit]
+}
+
+// addressTypes returns the address record types to serve for `services` where a query
+// doesn't pick a family, as in ANY answers and glue. With `AUTODNS_PREFER` set to `v4`
+// or `v6`, only that family is served, unless the services have no such address.
+func addressTypes(services []Service, now time.Time) []uint16 {
+	preferred := map[string]uint16{"v4": dns.TypeA, "v6": dns.TypeAAAA}[config.Prefer]
+	if preferred != 0 {
+		if ips, _ := addresses(services, preferred, now, nil); len(ips) > 0 {
+			return []uint16{preferred}
+		}
+	}
+	return []uint16{dns.TypeA, dns.TypeAAAA}
+}
+
+// weightedShuffle orders `ips` by `exp`, an exponential variate drawn for each address,
+// so that with random variates each address is picked for the next position with a
+// probability proportional to its weight. Equal weights give a uniform shuffle.
+func weightedShuffle(ips []net.IP, weights []uint, exp func(ip net.IP) float64) {
+	type keyed struct {
+		ip  net.IP
+		key float64
+	}
+
+	// Sorting by log(u)/weight samples without replacement by weight (Efraimidis-Spirakis)
+	order := make([]keyed, len(ips))
+	for i, ip := range ips {
+		order[i] = keyed{ip, -exp(ip) / float64(weights[i])}
+	}
+	slices.SortFunc(order, func(a, b keyed) int { return cmp.Compare(b.key, a.key) })
+
+	for i := range order {
+		ips[i] = order[i].ip
+	}
+}
+
+// SRVRecord describes an SRV record published as `<Service>.<hostname>`, e.g. `_web._tcp.app.local`.
+type SRVRecord struct {
+	Service  string
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   string
+
+	// The TTL, expiry and lease of the service publishing the record, set by newRegistry
+	TTL       uint32
+	ExpiresAt time.Time
+	LeaseEnd  time.Time
+}
+
+// owner returns the lifetime of the service publishing the record, for Service.TTL.
+func (r SRVRecord) owner() Service {
+	return Service{RecordTTL: r.TTL, ExpiresAt: r.ExpiresAt, LeaseEnd: r.LeaseEnd}
+}
+
+// newDockerClient connects to the Docker daemon at `host`, or the one configured by the
+// environment if `host` is "".
+func newDockerClient(host string) (*client.Client, error) {
+	opts := []client.Opt{client.FromEnv, client.WithAPIVersionNegotiation()}
+	if host != "" {
+		opts = append(opts, client.WithHost(host))
+	}
+	return client.NewClientWithOpts(opts...)
+}
+
+// dockerHosts returns the Docker daemons to discover on: `AUTODNS_DOCKER_HOSTS`, or
+// else just the one configured by the environment.
+func dockerHosts() []string {
+	if len(config.DockerHosts) == 0 {
+		return []string{""}
+	}
+	return config.DockerHosts
 }
 
-const TraefikLabelRegex = "traefik.http.routers.([\\w\\-\\_]+).rule=Host\\(`((?:(?:[a-zA-Z]|[a-zA-Z][a-zA-Z0-9\\-]*[a-zA-Z0-9])\\.)*(?:[A-Za-z]|[A-Za-z][A-Za-z0-9\\-]*[A-Za-z0-9]))`\\)"
+// dockerHostName names `host` for logging.
+func dockerHostName(host string) string {
+	if host == "" {
+		return "local"
+	}
+	return host
+}
+
+// dockerContext bounds Docker API calls by `AUTODNS_DOCKER_TIMEOUT`, unless it is 0.
+func dockerContext() (context.Context, context.CancelFunc) {
+	if config.DockerTimeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), config.DockerTimeout)
+}
+
+// discoveryFilters scopes discovery to containers carrying the `AUTODNS_LABEL_FILTER`
+// label, if set.
+func discoveryFilters() filters.Args {
+	args := filters.NewArgs()
+	if config.LabelFilter != "" {
+		args.Add("label", config.LabelFilter)
+	}
+	return args
+}
 
-func getContainers() ([]container.Summary, error) {
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+// onDiscoveryNetwork reports whether the container is attached to one of `AUTODNS_NETWORKS`,
+// or to any network if it is unset.
+func onDiscoveryNetwork(container container.Summary) bool {
+	if len(config.Networks) == 0 {
+		return true
+	}
+	if container.NetworkSettings == nil {
+		return false
+	}
+	for name := range container.NetworkSettings.Networks {
+		if slices.Contains(config.Networks, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// getContainers lists the running containers, or all of them with `AUTODNS_INCLUDE_STOPPED`,
+// matching the given Docker filters.
+func getContainers(ctx context.Context, host string, args filters.Args) ([]container.Summary, error) {
+	cli, err := newDockerClient(host)
 	if err != nil {
 		return nil, err
 	}
+	defer cli.Close()
 
-	containers, err := cli.ContainerList(context.Background(), container.ListOptions{All: true})
+	containers, err := cli.ContainerList(ctx, container.ListOptions{
+		All:     config.IncludeStopped,
+		Filters: args,
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -66,220 +458,1306 @@ func getContainers() ([]container.Summary, error) {
 	return containers, nil
 }
 
-func discoverTraefik() *Service {
+// isTraefik reports whether the container is a Traefik entrypoint: by its `com.autodns.role`
+// label if it has one, so custom images can opt in, or else by its image being `traefik`.
+func isTraefik(container container.Summary) bool {
+	if role, ok := container.Labels[labelKey("role")]; ok {
+		return strings.EqualFold(strings.TrimSpace(role), "traefik")
+	}
+	imageName := strings.Split(container.Image, ":")[0] // Get the image name without tag
+	return imageName == "traefik"
+}
+
+// discoverTraefik finds every Traefik container, keyed by its instance name: its
+// `com.autodns.name` label, or else its container name.
+func discoverTraefik(ctx context.Context, host string) (map[string]*Traefik, error) {
 	log.Info().Msg("Searching for Traefik services...")
 
-	containers, err := getContainers()
+	instances := make(map[string]*Traefik)
+
+	// Traefik itself needn't carry the `AUTODNS_LABEL_FILTER` label
+	containers, err := getContainers(ctx, host, filters.NewArgs())
 	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to get Docker containers")
-		return nil
+		return nil, fmt.Errorf("failed to get Docker containers: %w", err)
 	}
 
 	for _, container := range containers {
-		// Search for containers where the image is `traefik`
-		imageName := strings.Split(container.Image, ":")[0] // Get the image name without tag
-
-		if imageName != "traefik" {
+		if !isTraefik(container) {
 			continue
 		}
 
+		name := container.Labels[labelKey("name")]
+		if name == "" {
+			name = containerName(container)
+		}
+
+		hostname := traefikHostname(container)
+		traefik := &Traefik{
+			Service: Service{
+				ContainerName: containerName(container),
+				HostnameLabel: hostname,
+				RecordTTL:     containerTTL(container),
+			},
+			networks: traefikNetworks(container, hostname),
+		}
+
 		// Check if the container wants its own IP address
-		ipAddressLabel, ok := container.Labels["com.autodns.ip"]
+		ipAddressLabel, ok := container.Labels[labelKey("ip")]
 		if ok && ipAddressLabel != "" {
-			log.Info().Msgf("Container `%s` has its own IP address specified: `%s`", container.Names[0], ipAddressLabel)
-			return &Service{
-				ContainerName: container.Names[0],
-				HostnameLabel: "traefik",
-				IPAddress:     net.ParseIP(ipAddressLabel),
+			log.Info().Msgf("Container `%s` has its own IP address specified: `%s`", containerName(container), ipAddressLabel)
+			ip := net.ParseIP(ipAddressLabel)
+			if ip == nil {
+				log.Warn().Msgf("Container `%s` has an invalid IP address `%s`, skipping", containerName(container), ipAddressLabel)
+				continue
+			}
+			if !traefikHealthy(container, ipAddressLabel) {
+				continue
 			}
+			traefik.setAddress(ip)
+			instances[name] = traefik
+			continue
 		}
 
-		// Return the IP address
-		network, ok := container.Labels["com.autodns.network"]
-		if !ok {
-			network = "bridge" // Default to bridge network if not specified
+		// Traefik on the host network is reached at the host's address
+		if isHostNetwork(container) {
+			ip := hostIP()
+			if ip == nil {
+				log.Warn().Msgf("Traefik container `%s` is on the host network, but the host IP is unknown, not using it as a Traefik instance", containerName(container))
+				continue
+			}
+			if !traefikHealthy(container, ip.String()) {
+				continue
+			}
+			log.Info().Msgf("Found Traefik instance `%s` in container `%s` on the host network with IP `%s`", name, containerName(container), ip)
+			traefik.setAddress(ip)
+			traefik.Network = "host"
+			instances[name] = traefik
+			continue
 		}
 
-		// Ensure it has either the given network or the default bridge network
-		if _, exists := container.NetworkSettings.Networks[network]; !exists {
-			log.Warn().Msgf("Container `%s` is not on network `%s`, skipping", container.Names[0], network)
+		// Return the IP address
+		network, ok := selectNetwork(container)
+		if !ok {
 			continue
 		}
 
 		// Return the IP in that network
 		ip := container.NetworkSettings.Networks[network].IPAddress
-		if ip == "" {
-			log.Warn().Msgf("Container `%s` does not have an IP address in network `%s`, skipping", container.Names[0], network)
+		if net.ParseIP(ip) == nil {
+			log.Warn().Msgf("Traefik container `%s` does not have a usable IP address in network `%s` (%q), not using it as a Traefik instance", containerName(container), network, ip)
 			continue
 		}
 
-		log.Info().Msgf("Found Traefik service in container `%s` with IP `%s` on network `%s`", container.Names[0], ip, network)
-		return &Service{
-			ContainerName: container.Names[0],
-			HostnameLabel: "traefik",
-			IPAddress:     net.ParseIP(ip),
+		if !traefikHealthy(container, ip) {
+			continue
 		}
+
+		log.Info().Msgf("Found Traefik instance `%s` in container `%s` with IP `%s` on network `%s`", name, containerName(container), ip, network)
+		traefik.IPAddress = net.ParseIP(ip)
+		traefik.IPAddress6 = net.ParseIP(container.NetworkSettings.Networks[network].GlobalIPv6Address)
+		traefik.Network = network
+		instances[name] = traefik
 	}
 
-	return nil
+	return instances, nil
 }
 
-func discover() []Service {
-	log.Info().Msg("Discovering services...")
-	var discovered []Service
+// selectTraefik returns the Traefik instance a container is routed through: the one
+// named by its `com.autodns.traefik` label, else `AUTODNS_TRAEFIK_DEFAULT`, else the
+// only one discovered. It returns nil if none matches.
+func selectTraefik(instances map[string]*Traefik, container container.Summary) *Traefik {
+	name := container.Labels[labelKey("traefik")]
+	if name == "" {
+		name = config.TraefikDefault
+	}
+	if name != "" {
+		return instances[strings.TrimLeft(name, "/")]
+	}
 
-	containers, err := getContainers()
-	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to get Docker containers")
+	if len(instances) > 1 {
+		log.Warn().Msgf("Container `%s` doesn't choose between %d Traefik instances with `%s`", containerName(container), len(instances), labelKey("traefik"))
 		return nil
 	}
+	for _, traefik := range instances {
+		return traefik
+	}
+	return nil
+}
 
-	// Attempt to discover Traefik first
-	traefikIP := discoverTraefik()
-
-	traefikRe := regexp.MustCompile(TraefikLabelRegex)
+// selectNetwork picks the network whose address the container is served at: the one
+// named by its `com.autodns.network` label, else `AUTODNS_DEFAULT_NETWORK`, else its only
+// network. With `AUTODNS_EXCLUDE_BRIDGE`, Docker's `bridge` network comes last, see
+// candidateNetworks. It logs why and returns false when none can be picked.
+func selectNetwork(container container.Summary) (string, bool) {
+	var networks map[string]*network.EndpointSettings
+	if container.NetworkSettings != nil {
+		networks = container.NetworkSettings.Networks
+	}
 
-	for _, container := range containers {
+	if name, ok := container.Labels[labelKey("network")]; ok {
+		if _, exists := networks[name]; !exists {
+			log.Warn().Msgf("Container `%s` is not on network `%s`, skipping", containerName(container), name)
+			return "", false
+		}
+		return name, true
+	}
 
-		// Try autodns label first
-		hostname, ok := container.Labels["com.autodns.hostname"]
+	networks = candidateNetworks(networks)
+	if _, exists := networks[config.DefaultNetwork]; exists {
+		return config.DefaultNetwork, true
+	}
 
-		// If autodns label is not set, check Traefik labels
-		routed := false
-		if !ok || hostname == "" {
-			for label, value := range container.Labels {
-				matches := traefikRe.FindStringSubmatch(label + "=" + value)
-				if len(matches) == 3 {
-					hostname = matches[2] // 0 is the full match, 1 is the router name, 2 is the hostname
-					log.Debug().Msgf("Extracted Traefik hostname `%s` for service `%s` from container `%s`", hostname, matches[1], container.Names[0])
-
-					if traefikIP == nil {
-						log.Warn().Msgf("Container `%s` has Traefik hostname `%s`, but no Traefik service discovered, skipping", container.Names[0], hostname)
-						continue
-					}
-
-					// Route this service to Traefik
-					discovered = append(discovered, Service{
-						ContainerName: container.Names[0],
-						HostnameLabel: hostname,
-						IPAddress:     traefikIP.IPAddress,
-					})
-
-					log.Debug().Msgf("Container `%s` has Traefik hostname `%s`, routing to Traefik IP `%s`", container.Names[0], hostname, traefikIP.IPAddress)
-					routed = true
-					continue
-				}
-			}
+	if len(networks) == 1 {
+		for name := range networks {
+			log.Debug().Msgf("Container `%s` is only on network `%s`, using it", containerName(container), name)
+			return name, true
 		}
+	}
 
-		// Skip to the next container if routed to Traefik
-		if routed {
+	if len(networks) == 0 {
+		log.Warn().Msgf("Container `%s` is not on any network, skipping", containerName(container))
+	} else {
+		log.Warn().Msgf("Container `%s` is on %d networks but not `%s`, set `%s` to pick one, skipping", containerName(container), len(networks), config.DefaultNetwork, labelKey("network"))
+	}
+	return "", false
+}
+
+// candidateNetworks returns the networks a container without a `com.autodns.network`
+// label may be served on. With `AUTODNS_EXCLUDE_BRIDGE`, a container on Docker's `bridge`
+// network and a single other one is served on the other; on more, `bridge` stays the
+// fallback it always was.
+func candidateNetworks(networks map[string]*network.EndpointSettings) map[string]*network.EndpointSettings {
+	// Docker attaches containers to `bridge` unless told otherwise, rarely the network
+	// they're meant to be reached on
+	if _, onBridge := networks["bridge"]; config.ExcludeBridge && onBridge && len(networks) == 2 {
+		networks = maps.Clone(networks)
+		delete(networks, "bridge")
+	}
+	return networks
+}
+
+// networkServices copies `service` at the container's address on each of its networks,
+// in network name order, for `com.autodns.network=all`. Only the first copy keeps the
+// TXT, MX and verbatim records, so they aren't answered once per network.
+func networkServices(container container.Summary, service Service) []Service {
+	if container.NetworkSettings == nil {
+		return nil
+	}
+
+	var services []Service
+	for _, name := range slices.Sorted(maps.Keys(container.NetworkSettings.Networks)) {
+		endpoint := container.NetworkSettings.Networks[name]
+		if endpoint == nil || (endpoint.IPAddress == "" && endpoint.GlobalIPv6Address == "") {
+			log.Debug().Msgf("Container `%s` does not have an IP address in network `%s`, leaving it out", containerName(container), name)
 			continue
 		}
+		if len(services) > 0 {
+			service.TXT = nil
+			service.MX = nil
+			service.Records = nil
+		}
+		service.IPAddress = net.ParseIP(endpoint.IPAddress)
+		service.IPAddress6 = net.ParseIP(endpoint.GlobalIPv6Address)
+		service.Network = name
+		services = append(services, service)
+	}
+	return services
+}
 
-		// If still no hostname, skip this container
-		if hostname == "" {
+// traefikHostname returns the first hostname from the Traefik container's own
+// `com.autodns.hostname` label, or `traefik` without one.
+func traefikHostname(container container.Summary) string {
+	if hostnames := splitHostnames(container, container.Labels[labelKey("hostname")]); len(hostnames) > 0 {
+		return hostnames[0]
+	}
+	return "traefik"
+}
+
+// traefikNetworks collects the addresses of the Traefik container on each of its networks.
+func traefikNetworks(container container.Summary, hostname string) map[string]Service {
+	networks := make(map[string]Service)
+	if container.NetworkSettings == nil {
+		return networks
+	}
+	for name, settings := range container.NetworkSettings.Networks {
+		if settings == nil || net.ParseIP(settings.IPAddress) == nil {
 			continue
 		}
+		networks[name] = Service{
+			ContainerName: containerName(container),
+			HostnameLabel: hostname,
+			RecordTTL:     containerTTL(container),
+			IPAddress:     net.ParseIP(settings.IPAddress),
+			IPAddress6:    net.ParseIP(settings.GlobalIPv6Address),
+			Network:       name,
+		}
+	}
+	return networks
+}
+
+// traefikHealthy reports whether the Traefik container is fit to receive routed services.
+// It checks the Docker health status when `AUTODNS_TRAEFIK_REQUIRE_HEALTHY` is set, and
+// dials `AUTODNS_TRAEFIK_PROBE_PORT` on the given IP when a probe port is configured.
+func traefikHealthy(container container.Summary, ip string) bool {
+	if config.TraefikRequireHealthy {
+		if container.State != "running" {
+			log.Warn().Msgf("Traefik container `%s` is `%s`, withholding routed services", containerName(container), container.State)
+			return false
+		}
 
-		// Check if the container wants its own IP address
-		ipAddressLabel, ok := container.Labels["com.autodns.ip"]
-		if ok && ipAddressLabel != "" {
-			log.Info().Msgf("Container `%s` has its own IP address specified: `%s`", container.Names[0], ipAddressLabel)
-			discovered = append(discovered, Service{
-				ContainerName: container.Names[0],
-				HostnameLabel: hostname,
-				IPAddress:     net.ParseIP(ipAddressLabel),
-			})
-			continue
+		// Docker reports the health check result in the status, e.g. `Up 5 minutes (unhealthy)`
+		if strings.Contains(container.Status, "(unhealthy)") || strings.Contains(container.Status, "(health: starting)") {
+			log.Warn().Msgf("Traefik container `%s` is not healthy (`%s`), withholding routed services", containerName(container), container.Status)
+			return false
 		}
+	}
 
-		// Network selection
-		network, ok := container.Labels["com.autodns.network"]
-		if !ok {
-			network = "bridge"
+	if config.TraefikProbePort != 0 {
+		address := net.JoinHostPort(ip, strconv.Itoa(config.TraefikProbePort))
+		conn, err := net.DialTimeout("tcp", address, config.TraefikProbeTimeout)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Traefik container `%s` is unreachable at `%s`, withholding routed services", containerName(container), address)
+			return false
 		}
-		if _, exists := container.NetworkSettings.Networks[network]; !exists {
-			log.Warn().Msgf("Container `%s` is not on network `%s`, skipping", container.Names[0], network)
+		conn.Close()
+	}
+
+	return true
+}
+
+// traefikSRV builds SRV records for the entrypoints a Traefik router is bound to,
+// using the ports configured in `AUTODNS_TRAEFIK_ENTRYPOINT_PORTS`.
+func traefikSRV(labels map[string]string, router string, hostname string) []SRVRecord {
+	if len(config.TraefikEntrypointPorts) == 0 {
+		return nil
+	}
+
+	entrypoints, ok := labels["traefik.http.routers."+router+".entrypoints"]
+	if !ok || entrypoints == "" {
+		return nil
+	}
+
+	var records []SRVRecord
+	for _, entrypoint := range strings.Split(entrypoints, ",") {
+		entrypoint = strings.TrimSpace(entrypoint)
+		port, ok := config.TraefikEntrypointPorts[entrypoint]
+		if !ok {
+			log.Debug().Msgf("No port configured for Traefik entrypoint `%s` of router `%s`, skipping SRV record", entrypoint, router)
 			continue
 		}
 
-		discovered = append(discovered, Service{
-			ContainerName: container.Names[0],
-			HostnameLabel: hostname,
-			IPAddress:     net.ParseIP(container.NetworkSettings.Networks[network].IPAddress),
+		records = append(records, SRVRecord{
+			Service: "_" + entrypoint + "._tcp",
+			Port:    port,
+			Target:  hostname + ".",
 		})
 	}
 
-	log.Info().Msgf("Discovered %d services:", len(discovered))
-	for _, service := range discovered {
-		log.Info().Msgf(" - %s (%s) -> %s", service.ContainerName, service.HostnameLabel, service.IPAddress)
+	return records
+}
+
+// containerName returns the container's primary name without Docker's leading slashes,
+// e.g. `grafana` for `/grafana`. Legacy links add names like `/app/db` in no set order,
+// so the shortest name wins, then the first alphabetically.
+func containerName(container container.Summary) string {
+	var name string
+	for _, candidate := range container.Names {
+		candidate = strings.TrimLeft(candidate, "/")
+		if candidate == "" {
+			continue
+		}
+		if name == "" || len(candidate) < len(name) || (len(candidate) == len(name) && candidate < name) {
+			name = candidate
+		}
 	}
-	return discovered
+	if name == "" {
+		return container.ID
+	}
+	return name
 }
 
-func main() {
-	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stdout, NoColor: false})
-	log.Info().Msg("Starting AutoDNS...")
+// labelKey returns the full key of an AutoDNS label, e.g. `com.autodns.hostname` for
+// `hostname` with the default `AUTODNS_LABEL_PREFIX`.
+func labelKey(name string) string {
+	return config.LabelPrefix + "." + name
+}
 
-	serverUDP := &dns.Server{
-		Addr: ":53",
-		Net:  "udp",
+// containerExpiry parses the container's `com.autodns.expires_at` RFC3339 label.
+// It returns the zero time if the label is missing or malformed.
+func containerExpiry(container container.Summary) time.Time {
+	value, ok := container.Labels[labelKey("expires_at")]
+	if !ok || value == "" {
+		return time.Time{}
 	}
-	serverTCP := &dns.Server{
-		Addr: ":53",
-		Net:  "tcp",
+
+	expiresAt, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Container `%s` has an invalid expiry `%s`, ignoring", containerName(container), value)
+		return time.Time{}
 	}
+	return expiresAt
+}
+
+// containerIgnored reports whether the container opts out of discovery with a true
+// `com.autodns.ignore` label.
+func containerIgnored(container container.Summary) bool {
+	ignore, _ := strconv.ParseBool(container.Labels[labelKey("ignore")])
+	return ignore
+}
+
+// containerWildcard reports whether the container also answers for every subdomain of
+// its hostnames, with a true `com.autodns.wildcard` label.
+func containerWildcard(container container.Summary) bool {
+	wildcard, _ := strconv.ParseBool(container.Labels[labelKey("wildcard")])
+	return wildcard
+}
 
-	// Discover services
-	services := discover()
-	if len(services) == 0 {
-		log.Warn().Msg("No services discovered, DNS server will not respond to queries")
+// wildcardOf returns the wildcard name covering the subdomains of `hostname`, or "" if
+// it already is a wildcard.
+func wildcardOf(hostname string) string {
+	if strings.HasPrefix(hostname, "*.") {
+		return ""
 	}
+	return "*." + hostname
+}
 
-	go func() {
-		if err := serverUDP.ListenAndServe(); err != nil {
-			log.Fatal().Err(err).Msg("Failed to start UDP DNS server")
-		}
-	}()
-	go func() {
-		if err := serverTCP.ListenAndServe(); err != nil {
-			log.Fatal().Err(err).Msg("Failed to start TCP DNS server")
-		}
-	}()
+// publishedFamilies keeps only the addresses of the family named by the container's
+// `com.autodns.family` label, `v4`, `v6` or `both` (the default), dropping services left
+// without an address.
+func publishedFamilies(container container.Summary, services []Service) []Service {
+	family := strings.ToLower(container.Labels[labelKey("family")])
+	switch family {
+	case "", "both":
+		return services
+	case "v4", "v6":
+	default:
+		log.Warn().Msgf("Container `%s` has an invalid address family %q, expected `v4`, `v6` or `both`, publishing both", containerName(container), family)
+		return services
+	}
 
-	// Build a map for quick lookup
-	serviceMap := make(map[string]string)
+	var kept []Service
 	for _, service := range services {
-		serviceMap[service.HostnameLabel+"."] = service.IPAddress.String()
+		if service.CNAME == "" {
+			if family == "v4" {
+				service.IPAddress6 = nil
+			} else {
+				service.IPAddress = nil
+			}
+			if service.IPAddress == nil && service.IPAddress6 == nil {
+				log.Warn().Msgf("Container `%s` has no %s address for `%s`, skipping it", containerName(container), family, service.HostnameLabel)
+				continue
+			}
+		}
+		kept = append(kept, service)
 	}
+	return kept
+}
 
-	dns.HandleFunc(".", func(w dns.ResponseWriter, r *dns.Msg) {
-		if len(r.Question) == 0 {
-			log.Warn().Msg("Received DNS query with no questions")
-			return
-		}
-		q := r.Question[0]
-		name := q.Name
-		ip, ok := serviceMap[name]
-		if !ok {
-			log.Warn().Msgf("No service found for hostname: %s", name)
-			m := new(dns.Msg)
-			m.SetReply(r)
-			w.WriteMsg(m) // Empty response
-			return
-		}
-		resp := makeResponse(name, net.ParseIP(ip))
-		resp.SetReply(r)
-		if err := w.WriteMsg(resp); err != nil {
-			log.Error().Err(err).Msgf("Failed to write DNS response for %s", name)
-			return
-		}
-		log.Info().Msgf("DNS response sent for %s: %s", name, ip)
-	})
+// containerTTL parses the container's `com.autodns.ttl` label as a number of seconds,
+// falling back to the global `AUTODNS_TTL` when it is missing or malformed. A TTL of 0
+// is honored, telling resolvers not to cache the records at all.
+func containerTTL(container container.Summary) uint32 {
+	value, ok := container.Labels[labelKey("ttl")]
+	if !ok || value == "" {
+		return config.TTL
+	}
+
+	ttl, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		log.Warn().Msgf("Container `%s` has an invalid TTL `%s`, using the default of %d", containerName(container), value, config.TTL)
+		return config.TTL
+	}
+	return uint32(ttl)
+}
 
-	log.Info().Msg("DNS server started")
+// containerWeight parses the container's `com.autodns.weight` label, a positive integer
+// biasing round-robin towards it, defaulting to 1 when missing or malformed.
+func containerWeight(container container.Summary) uint {
+	value, ok := container.Labels[labelKey("weight")]
+	if !ok || value == "" {
+		return 1
+	}
 
-	// Wait forever
-	select {}
+	weight, err := strconv.ParseUint(value, 10, 16)
+	if err != nil || weight == 0 {
+		log.Warn().Msgf("Container `%s` has an invalid weight %q, using 1", containerName(container), value)
+		return 1
+	}
+	return uint(weight)
+}
+
+// containerTXT splits the container's comma-separated `com.autodns.txt` label into its values.
+func containerTXT(container container.Summary) []string {
+	var values []string
+	for _, value := range strings.Split(container.Labels[labelKey("txt")], ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// containerSRV parses the container's comma-separated `com.autodns.srv` label, whose
+// entries look like `_http._tcp=80`, or `_http._tcp=80:10:5` to also set the priority
+// and weight. Entries leaving them out take the `com.autodns.srv.priority` and
+// `com.autodns.srv.weight` labels. The records have no target yet, see srvTargeting.
+func containerSRV(container container.Summary) []SRVRecord {
+	priority, weight := containerSRVNumber(container, "priority"), containerSRVNumber(container, "weight")
+
+	var records []SRVRecord
+	for _, entry := range strings.Split(container.Labels[labelKey("srv")], ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		service, values, ok := strings.Cut(entry, "=")
+		if _, valid := dns.IsDomainName(service); !ok || !valid || !strings.HasPrefix(service, "_") {
+			log.Warn().Msgf("Container `%s` has an invalid SRV entry `%s`, skipping", containerName(container), entry)
+			continue
+		}
+
+		numbers, ok := parseSRVNumbers(values)
+		if !ok || numbers[0] == 0 {
+			log.Warn().Msgf("Container `%s` has an invalid SRV entry `%s`, skipping", containerName(container), entry)
+			continue
+		}
+		switch strings.Count(values, ":") {
+		case 0:
+			numbers[1], numbers[2] = priority, weight
+		case 1:
+			numbers[2] = weight
+		}
+
+		records = append(records, SRVRecord{
+			Service:  strings.TrimSuffix(service, "."),
+			Port:     numbers[0],
+			Priority: numbers[1],
+			Weight:   numbers[2],
+		})
+	}
+	return records
+}
+
+// containerSRVNumber parses the container's `com.autodns.srv.<field>` label, the
+// priority or weight of its SRV entries that don't set their own, 0 if unset.
+func containerSRVNumber(container container.Summary, field string) uint16 {
+	value, ok := container.Labels[labelKey("srv."+field)]
+	if !ok || value == "" {
+		return 0
+	}
+
+	n, err := strconv.ParseUint(value, 10, 16)
+	if err != nil {
+		log.Warn().Msgf("Container `%s` has an invalid SRV %s %q, expected 0 to 65535, using 0", containerName(container), field, value)
+		return 0
+	}
+	return uint16(n)
+}
+
+// parseSRVNumbers parses `port[:priority[:weight]]`, leaving omitted values at 0.
+func parseSRVNumbers(value string) (numbers [3]uint16, ok bool) {
+	fields := strings.Split(value, ":")
+	if len(fields) > len(numbers) {
+		return numbers, false
+	}
+	for i, field := range fields {
+		n, err := strconv.ParseUint(field, 10, 16)
+		if err != nil {
+			return numbers, false
+		}
+		numbers[i] = uint16(n)
+	}
+	return numbers, true
+}
+
+// srvTargeting returns copies of `records` pointing at `hostname`.
+func srvTargeting(records []SRVRecord, hostname string) []SRVRecord {
+	if len(records) == 0 {
+		return nil
+	}
+	targeted := make([]SRVRecord, len(records))
+	for i, record := range records {
+		record.Target = hostname + "."
+		targeted[i] = record
+	}
+	return targeted
+}
+
+// containerLeaseEnd computes when the container is expected to stop, from its creation
+// time and `com.autodns.max_lifetime` duration label. It returns the zero time if the
+// label is missing or malformed.
+func containerLeaseEnd(container container.Summary) time.Time {
+	value, ok := container.Labels[labelKey("max_lifetime")]
+	if !ok || value == "" {
+		return time.Time{}
+	}
+
+	lifetime, err := time.ParseDuration(value)
+	if err != nil || lifetime <= 0 {
+		log.Warn().Msgf("Container `%s` has an invalid max lifetime `%s`, ignoring", containerName(container), value)
+		return time.Time{}
+	}
+	return time.Unix(container.Created, 0).Add(lifetime)
+}
+
+// splitHostnames splits a comma-separated `com.autodns.hostname` label into its
+// hostnames, skipping empty entries and ones that aren't valid DNS names.
+func splitHostnames(container container.Summary, label string) []string {
+	var hostnames []string
+	for _, hostname := range strings.Split(label, ",") {
+		hostname = strings.TrimSpace(hostname)
+		if hostname == "" {
+			continue
+		}
+		qualified := qualifyHostname(hostname)
+		if !validHostname(qualified) {
+			log.Warn().Msgf("Container `%s` has invalid hostname %q, skipping it", containerName(container), hostname)
+			continue
+		}
+		hostnames = append(hostnames, qualified)
+	}
+	return hostnames
+}
+
+// composeHostname builds `<service>.<project>` from the container's Docker Compose labels,
+// under `AUTODNS_DOMAIN` if set. It returns "" for containers not started by Compose.
+func composeHostname(container container.Summary) string {
+	service := container.Labels["com.docker.compose.service"]
+	project := container.Labels["com.docker.compose.project"]
+	if service == "" || project == "" {
+		return ""
+	}
+
+	hostname := service + "." + project
+	if config.Domain != "" {
+		hostname += "." + config.Domain
+	}
+	log.Debug().Msgf("Container `%s` is named `%s` after its Compose service", containerName(container), hostname)
+	return hostname
+}
+
+// validHostname reports whether a qualified hostname can be registered: at most 253
+// characters, in labels of letters, digits, hyphens and underscores, optionally led
+// by a `*` wildcard label. Anything else, such as control characters smuggled in
+// through a label, is rejected.
+func validHostname(hostname string) bool {
+	if hostname == "" || len(hostname) > 253 {
+		return false
+	}
+	if _, ok := dns.IsDomainName(hostname); !ok {
+		return false
+	}
+
+	for i, label := range strings.Split(hostname, ".") {
+		if label == "*" && i == 0 {
+			continue
+		}
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// inspectHostname returns the hostname and domain name the container was started with,
+// or "" if it kept Docker's default of its short ID. Container summaries lack these.
+func inspectHostname(ctx context.Context, host string, container container.Summary) string {
+	cli, err := newDockerClient(host)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to create Docker client")
+		return ""
+	}
+	defer cli.Close()
+
+	inspect, err := cli.ContainerInspect(ctx, container.ID)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Failed to inspect container `%s`", containerName(container))
+		return ""
+	}
+	if inspect.Config == nil || inspect.Config.Hostname == "" || strings.HasPrefix(container.ID, inspect.Config.Hostname) {
+		return ""
+	}
+
+	hostname := inspect.Config.Hostname
+	if inspect.Config.Domainname != "" {
+		hostname += "." + inspect.Config.Domainname
+	}
+	log.Debug().Msgf("Container `%s` is named `%s` after its configured hostname", containerName(container), hostname)
+	return hostname
+}
+
+// qualifyHostname lowercases `hostname`, converts Unicode labels to their punycode
+// form, strips any trailing dot and, if it is a single label, appends the configured
+// `AUTODNS_DOMAIN`. Names that already contain a dot are kept as is.
+func qualifyHostname(hostname string) string {
+	hostname = strings.TrimSuffix(strings.ToLower(hostname), ".")
+
+	// Queries carry internationalized names in their ASCII form
+	if ascii, err := idna.ToASCII(hostname); err != nil {
+		log.Warn().Err(err).Msgf("Hostname `%s` can't be converted to ASCII, keeping it as is", hostname)
+	} else if ascii != hostname {
+		log.Debug().Msgf("Hostname `%s` is served as `%s`", hostname, ascii)
+		hostname = ascii
+	}
+
+	if config.Domain == "" || strings.Contains(hostname, ".") {
+		return hostname
+	}
+	return hostname + "." + config.Domain
+}
+
+// dedupeServices drops services repeating the hostname and addresses of an earlier
+// one, keeping distinct addresses of a shared hostname.
+func dedupeServices(services []Service) []Service {
+	type key struct{ hostname, ip, ip6, cname string }
+	seen := make(map[key]bool, len(services))
+
+	deduped := services[:0]
+	for _, service := range services {
+		k := key{service.HostnameLabel, service.IPAddress.String(), service.IPAddress6.String(), service.CNAME}
+		if seen[k] {
+			log.Debug().Msgf("Dropping duplicate `%s` of container `%s`", service.HostnameLabel, service.ContainerName)
+			continue
+		}
+		seen[k] = true
+		deduped = append(deduped, service)
+	}
+	return deduped
+}
+
+// discoverAll gathers the services from every source: containers on each Docker host,
+// Swarm services when enabled, the zone file, static hosts and the hosts file. Docker
+// calls give up after `AUTODNS_DOCKER_TIMEOUT`. A host that can't be reached keeps its
+// previously discovered services, unless every host fails.
+func discoverAll() ([]Service, error) {
+	ctx, cancel := dockerContext()
+	defer cancel()
+
+	var services []Service
+	var errs []error
+	for _, host := range dockerHosts() {
+		discovered, err := discover(ctx, host)
+		if err != nil {
+			stale := registry.Load().ServicesOf(host)
+			log.Error().Err(err).Msgf("Failed to discover services on Docker host `%s`, keeping its %d previous services", dockerHostName(host), len(stale))
+			services = append(services, stale...)
+			errs = append(errs, err)
+			continue
+		}
+		if config.Swarm {
+			discovered = append(discovered, discoverSwarm(ctx, host)...)
+		}
+		for i := range discovered {
+			discovered[i].DockerHost = host
+		}
+		services = append(services, discovered...)
+	}
+	if len(errs) == len(dockerHosts()) {
+		return nil, errors.Join(errs...)
+	}
+
+	// Hosts of the same Swarm report its services each
+	services = dedupeServices(services)
+	return mergeHostsFile(append(mergeZonefile(services), staticServices()...)), nil
+}
+
+// discover builds the services of the containers on the Docker daemon at `host`.
+func discover(ctx context.Context, host string) ([]Service, error) {
+	log.Info().Msgf("Discovering services on Docker host `%s`...", dockerHostName(host))
+	var discovered []Service
+
+	containers, err := getContainers(ctx, host, discoveryFilters())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Docker containers: %w", err)
+	}
+
+	// Attempt to discover Traefik first
+	traefiks, err := discoverTraefik(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, container := range containers {
+		if !onDiscoveryNetwork(container) {
+			log.Debug().Msgf("Container `%s` is on none of `AUTODNS_NETWORKS`, skipping", containerName(container))
+			continue
+		}
+		discovered = append(discovered, safeDiscoverContainer(ctx, host, container, traefiks)...)
+
+		// Every container also gets a debugging handle by name and ID, if enabled
+		if config.NameZone != "" && !containerIgnored(container) {
+			discovered = append(discovered, nameZoneServices(container)...)
+		}
+		if config.UseNetworkAliases && !containerIgnored(container) {
+			discovered = append(discovered, networkAliasServices(container)...)
+		}
+	}
+
+	discovered = dedupeServices(discovered)
+
+	log.Info().Msgf("Discovered %d services:", len(discovered))
+	for _, service := range discovered {
+		if service.CNAME != "" {
+			log.Info().Msgf(" - %s (%s) -> CNAME %s", service.ContainerName, service.HostnameLabel, service.CNAME)
+			continue
+		}
+		if service.IPAddress6 != nil {
+			log.Info().Msgf(" - %s (%s) -> %s, %s", service.ContainerName, service.HostnameLabel, service.IPAddress, service.IPAddress6)
+			continue
+		}
+		log.Info().Msgf(" - %s (%s) -> %s", service.ContainerName, service.HostnameLabel, service.IPAddress)
+	}
+	return discovered, nil
+}
+
+// safeDiscoverContainer runs discoverContainer, logging and skipping the container
+// instead of aborting discovery if it panics, e.g. on an unexpected nil field.
+func safeDiscoverContainer(ctx context.Context, host string, container container.Summary, traefiks map[string]*Traefik) (services []Service) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error().Msgf("Discovering container `%s` failed, skipping it: %v", containerName(container), r)
+			services = nil
+		}
+	}()
+
+	container, cfg, err := expandLabelConfig(container)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Container `%s` has an invalid `%s` label, skipping", containerName(container), labelKey("config"))
+		return nil
+	}
+	return publishedFamilies(container, cfg.apply(discoverContainer(ctx, host, container, traefiks)))
+}
+
+// discoverContainer builds the services of a single container on `host`, routing it
+// through one of `traefiks` when it only has Traefik router rules.
+func discoverContainer(ctx context.Context, host string, container container.Summary, traefiks map[string]*Traefik) []Service {
+	var discovered []Service
+
+	// Opted out, whatever its other labels say
+	if containerIgnored(container) {
+		log.Debug().Msgf("Container `%s` is ignored with `%s`, skipping", containerName(container), labelKey("ignore"))
+		return nil
+	}
+
+	// Drop services past their expiry
+	expiresAt := containerExpiry(container)
+	if !expiresAt.IsZero() && !time.Now().Before(expiresAt) {
+		log.Info().Msgf("Container `%s` expired at %s, skipping", containerName(container), expiresAt.Format(time.RFC3339))
+		return nil
+	}
+	leaseEnd := containerLeaseEnd(container)
+	recordTTL := containerTTL(container)
+	weight := containerWeight(container)
+	txt := containerTXT(container)
+	mx := containerMX(container)
+	records := containerRecords(container)
+	srv := containerSRV(container)
+	aliases := splitHostnames(container, container.Labels[labelKey("aliases")])
+
+	// Try autodns label first
+	hostname, ok := container.Labels[labelKey("hostname")]
+
+	// If autodns label is not set, check Traefik labels
+	if !ok || hostname == "" {
+		routed := false
+		var primary *Service               // The first Traefik-routed name, which aliases copy
+		claimed := make(map[string]string) // Router each host is routed by
+
+		// The highest priority router claiming a host wins, as it does in Traefik
+		for _, r := range traefikRouters(container) {
+			router := r.name
+			if !r.servedEntrypoint() {
+				log.Debug().Msgf("Router `%s` of container `%s` is on none of `AUTODNS_TRAEFIK_ENTRYPOINTS`, skipping", router, containerName(container))
+				routed = true // Still Traefik's, so no fallback name either
+				continue
+			}
+
+			hosts, hasRegexp := parseTraefikRule(r.rule)
+			if hasRegexp {
+				log.Warn().Msgf("Router `%s` of container `%s` uses `HostRegexp`, which is not supported", router, containerName(container))
+			}
+
+			for _, host := range hosts {
+				qualified := qualifyHostname(rewriteTraefikHost(host))
+				if !validHostname(qualified) {
+					log.Warn().Msgf("Router `%s` of container `%s` has invalid hostname %q, skipping", router, containerName(container), host)
+					continue
+				}
+				host = qualified
+				if owner, ok := claimed[host]; ok {
+					log.Debug().Msgf("Router `%s` of container `%s` claims `%s`, already routed by higher priority router `%s`, skipping", router, containerName(container), host, owner)
+					continue
+				}
+				claimed[host] = router
+				log.Debug().Msgf("Extracted Traefik hostname `%s` for service `%s` from container `%s`", host, router, containerName(container))
+				routed = true
+
+				traefik := selectTraefik(traefiks, container)
+				if traefik == nil {
+					log.Warn().Msgf("Container `%s` has Traefik hostname `%s`, but no matching Traefik instance discovered, skipping", containerName(container), host)
+					continue
+				}
+
+				// Reach Traefik on the container's own network, if it names one
+				traefikIP, ok := traefik.On(container.Labels[labelKey("network")])
+				if !ok {
+					log.Warn().Msgf("Traefik container `%s` is not on network `%s` of container `%s`, skipping", traefik.ContainerName, container.Labels[labelKey("network")], containerName(container))
+					continue
+				}
+				if traefikIP.IPAddress == nil && traefikIP.IPAddress6 == nil {
+					log.Warn().Msgf("Traefik container `%s` has no IP address to route hostname `%s` of container `%s` to, skipping", traefik.ContainerName, host, containerName(container))
+					continue
+				}
+
+				// Route this service to Traefik
+				discovered = append(discovered, Service{
+					ContainerName: containerName(container),
+					HostnameLabel: host,
+					IPAddress:     traefikIP.IPAddress,
+					IPAddress6:    traefikIP.IPAddress6,
+					Network:       traefikIP.Network,
+					Via:           traefik.ContainerName,
+					SRV:           append(traefikSRV(container.Labels, router, host), srvTargeting(srv, host)...),
+					TXT:           txt,
+					MX:            mx,
+					Records:       records,
+					RecordTTL:     recordTTL,
+					Weight:        weight,
+					ExpiresAt:     expiresAt,
+					LeaseEnd:      leaseEnd,
+				})
+				if primary == nil {
+					first := discovered[len(discovered)-1]
+					primary = &first
+				}
+
+				log.Debug().Msgf("Container `%s` has Traefik hostname `%s`, routing to Traefik IP `%s`", containerName(container), host, traefikIP.IPAddress)
+			}
+		}
+
+		// Aliases route to Traefik like the router hosts, without their SRV records
+		if primary != nil {
+			for _, alias := range aliases {
+				service := *primary
+				service.HostnameLabel = alias
+				service.SRV = nil
+				discovered = append(discovered, service)
+			}
+		}
+
+		// And so do the subdomains of every name, when asked for
+		if containerWildcard(container) {
+			for _, service := range discovered {
+				if wildcard := wildcardOf(service.HostnameLabel); wildcard != "" {
+					service.HostnameLabel = wildcard
+					service.SRV = nil
+					discovered = append(discovered, service)
+				}
+			}
+		}
+
+		// Done if handled by Traefik
+		if routed {
+			return discovered
+		}
+	}
+
+	// Optionally name unlabelled Compose containers after their service and project
+	if hostname == "" && config.ComposeAutoname {
+		hostname = composeHostname(container)
+	}
+
+	// Optionally fall back to the container's own `--hostname`, which costs an inspect call
+	if hostname == "" && config.UseContainerHostname {
+		hostname = inspectHostname(ctx, host, container)
+	}
+
+	// If still no hostname, skip this container
+	hostnames := splitHostnames(container, hostname)
+	if len(hostnames) == 0 {
+		return nil
+	}
+	hostnames = append(hostnames, aliases...)
+	if containerWildcard(container) {
+		for _, hostname := range hostnames {
+			if wildcard := wildcardOf(hostname); wildcard != "" {
+				hostnames = append(hostnames, wildcard)
+			}
+		}
+	}
+
+	service := Service{
+		ContainerName: containerName(container),
+		TXT:           txt,
+		MX:            mx,
+		Records:       records,
+		RecordTTL:     recordTTL,
+		Weight:        weight,
+		ExpiresAt:     expiresAt,
+		LeaseEnd:      leaseEnd,
+	}
+
+	// The container's published addresses, several when multi-homed with `all`
+	published := []Service{service}
+
+	// Check if the container aliases another name, or wants its own IP address
+	cnameLabel, isAlias := container.Labels[labelKey("cname")]
+	ipAddressLabel, ok := container.Labels[labelKey("ip")]
+	if isAlias && cnameLabel != "" {
+		if !validHostname(strings.TrimSuffix(strings.ToLower(cnameLabel), ".")) {
+			log.Warn().Msgf("Container `%s` has invalid CNAME target %q, skipping", containerName(container), cnameLabel)
+			return nil
+		}
+		log.Info().Msgf("Container `%s` is an alias for `%s`", containerName(container), cnameLabel)
+		published[0].CNAME = dns.Fqdn(strings.ToLower(cnameLabel))
+	} else if ok && ipAddressLabel != "" {
+		log.Info().Msgf("Container `%s` has its own IP address specified: `%s`", containerName(container), ipAddressLabel)
+		ip := net.ParseIP(ipAddressLabel)
+		if ip == nil {
+			log.Warn().Msgf("Container `%s` has an invalid IP address `%s`, skipping", containerName(container), ipAddressLabel)
+			return nil
+		}
+		published[0].setAddress(ip)
+	} else if isHostNetwork(container) {
+		ip := hostIP()
+		if ip == nil {
+			log.Warn().Msgf("Container `%s` is on the host network, but the host IP is unknown, set `AUTODNS_HOST_IP`, skipping", containerName(container))
+			return nil
+		}
+		published[0].setAddress(ip)
+		published[0].Network = "host"
+	} else if container.Labels[labelKey("network")] == "all" {
+		published = networkServices(container, service)
+		if len(published) == 0 {
+			log.Warn().Msgf("Container `%s` does not have an IP address in any network, skipping", containerName(container))
+			return nil
+		}
+	} else {
+		// Network selection
+		network, ok := selectNetwork(container)
+		if !ok {
+			return nil
+		}
+
+		// Containers can sit on a network without an address yet, e.g. while starting
+		endpoint := container.NetworkSettings.Networks[network]
+		if endpoint.IPAddress == "" && endpoint.GlobalIPv6Address == "" {
+			log.Warn().Msgf("Container `%s` does not have an IP address in network `%s`, skipping", containerName(container), network)
+			return nil
+		}
+		published[0].IPAddress = net.ParseIP(endpoint.IPAddress)
+		published[0].IPAddress6 = net.ParseIP(endpoint.GlobalIPv6Address)
+		published[0].Network = network
+	}
+
+	// Register every hostname of the container at the same addresses
+	for _, hostname := range hostnames {
+		for i, service := range published {
+			service.HostnameLabel = hostname
+			if i == 0 && !strings.HasPrefix(hostname, "*.") {
+				service.SRV = srvTargeting(srv, hostname)
+			}
+			discovered = append(discovered, service)
+		}
+	}
+	return discovered
+}
+
+// configureLogging sets up the global logger from `AUTODNS_LOG_FORMAT` and `AUTODNS_LOG_LEVEL`.
+func configureLogging() {
+	// A dry run prints the zone on stdout, so keep logs out of it
+	var dest io.Writer = os.Stdout
+	if config.DryRun {
+		dest = os.Stderr
+	}
+
+	var out io.Writer = zerolog.ConsoleWriter{Out: dest, NoColor: false}
+	if config.LogFormat == "json" {
+		out = dest
+	}
+	log.Logger = zerolog.New(out).With().Timestamp().Str("instance", config.InstanceID).Logger()
+
+	if config.LogFormat != "json" && config.LogFormat != "console" {
+		log.Warn().Msgf("Unknown log format `%s`, using `console`", config.LogFormat)
+	}
+
+	level, err := zerolog.ParseLevel(config.LogLevel)
+	if err != nil || level == zerolog.NoLevel {
+		log.Warn().Msgf("Unknown log level `%s`, using `info`", config.LogLevel)
+		level = zerolog.InfoLevel
+	}
+	zerolog.SetGlobalLevel(level)
+}
+
+func main() {
+	showVersion := flag.Bool("version", false, "print the build version and exit")
+	flag.Parse()
+	if *showVersion {
+		fmt.Println("AutoDNS " + versionString())
+		return
+	}
+
+	cfg, err := loadConfig()
+	config = cfg
+
+	configureLogging()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load configuration")
+	}
+	log.Info().Msgf("Starting AutoDNS %s...", versionString())
+	logConfig(config)
+
+	initMetrics()
+
+	if config.Zonefile != "" {
+		if err := loadZonefile(); err != nil {
+			log.Fatal().Err(err).Msg("Failed to load zone file")
+		}
+	}
+	if config.HostsFile != "" {
+		if err := loadHostsFile(); err != nil {
+			log.Fatal().Err(err).Msg("Failed to load hosts file")
+		}
+	}
+	setMaintenance(config.MaintenanceIP)
+
+	if config.DryRun {
+		if err := dryRun(os.Stdout); err != nil {
+			log.Fatal().Err(err).Msg("Failed to discover services")
+		}
+		return
+	}
+
+	// Stop cleanly on `docker stop` and Ctrl-C
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if config.BindNetwork != "" {
+		addr, err := bindNetworkAddress(config.BindNetwork, config.Listen)
+		if err != nil {
+			log.Fatal().Err(err).Msgf("Failed to bind to Docker network `%s`", config.BindNetwork)
+		}
+		log.Info().Msgf("Binding to `%s` on Docker network `%s`", addr, config.BindNetwork)
+		config.Listen = addr
+	}
+
+	// Forwarding to ourselves would loop every unknown query
+	config.Upstream = slices.DeleteFunc(config.Upstream, func(upstream string) bool {
+		if upstreamIsSelf(upstream, config.Listen) {
+			log.Error().Msgf("Upstream `%s` points back at this server, ignoring it", upstream)
+			return true
+		}
+		return false
+	})
+
+	if config.Cache && len(config.Upstream) > 0 {
+		upstreamCache = newResponseCache(config.CacheSize)
+	}
+
+	// Every listener gets its own mux, all answering from the same resolver
+	resolver := newResolver(&registry)
+
+	serverUDP := &dns.Server{
+		Addr:              config.Listen,
+		Net:               "udp",
+		Handler:           newDNSMux(resolver),
+		MsgAcceptFunc:     acceptQuery,
+		NotifyStartedFunc: func() { listeningUDP.Store(true) },
+	}
+	serverTCP := &dns.Server{
+		Addr:              config.Listen,
+		Net:               "tcp",
+		Handler:           newDNSMux(resolver),
+		MsgAcceptFunc:     acceptQuery,
+		IdleTimeout:       func() time.Duration { return config.TCPIdleTimeout },
+		NotifyStartedFunc: func() { listeningTCP.Store(true) },
+	}
+
+	// The certificate is shared by DNS-over-TLS and DNS-over-HTTPS, and reloaded when renewed
+	var certs *certReloader
+	if config.TLSCert != "" && config.TLSKey != "" {
+		certs, err = newCertReloader(config.TLSCert, config.TLSKey)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to load TLS certificate")
+		}
+	}
+
+	// Optional DNS-over-TLS listener, sharing the same handler
+	var serverDoT *dns.Server
+	if config.DoTAddr != "" {
+		serverDoT = &dns.Server{
+			Addr:          config.DoTAddr,
+			Net:           "tcp-tls",
+			Handler:       newDNSMux(resolver),
+			MsgAcceptFunc: acceptQuery,
+			TLSConfig:     &tls.Config{GetCertificate: certs.GetCertificate, MinVersion: tls.VersionTLS12},
+			IdleTimeout:   func() time.Duration { return config.TCPIdleTimeout },
+		}
+	}
+
+	// Optional Unix socket listener for local tooling, speaking DNS as over TCP
+	var serverUnix *dns.Server
+	if config.UnixSocket != "" {
+		serverUnix = &dns.Server{
+			Addr:          config.UnixSocket,
+			Net:           "tcp",
+			Handler:       newDNSMux(resolver),
+			MsgAcceptFunc: acceptQuery,
+			IdleTimeout:   func() time.Duration { return config.TCPIdleTimeout },
+		}
+	}
+
+	// Bind every listener up front, so a port still held elsewhere is retried before giving up
+	conn, err := listenWithRetry(ctx, "UDP DNS server", serverUDP.Addr, func() (net.PacketConn, error) {
+		return net.ListenPacket("udp", serverUDP.Addr)
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to start UDP DNS server")
+	}
+	serverUDP.PacketConn = conn
+
+	listener, err := listenWithRetry(ctx, "TCP DNS server", serverTCP.Addr, func() (net.Listener, error) {
+		return net.Listen("tcp", serverTCP.Addr)
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to start TCP DNS server")
+	}
+
+	// Bound the number of concurrent TCP connections if requested
+	if config.TCPMaxConnections > 0 {
+		limited := newLimitListener(listener, config.TCPMaxConnections)
+		registerTCPMetrics(limited)
+		listener = limited
+	}
+	serverTCP.Listener = listener
+
+	if serverDoT != nil {
+		listener, err := listenWithRetry(ctx, "DNS-over-TLS server", serverDoT.Addr, func() (net.Listener, error) {
+			return net.Listen("tcp", serverDoT.Addr)
+		})
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to start DNS-over-TLS server")
+		}
+		serverDoT.Listener = tls.NewListener(listener, serverDoT.TLSConfig)
+	}
+
+	if serverUnix != nil {
+		listener, err := listenWithRetry(ctx, "Unix socket DNS server", serverUnix.Addr, func() (net.Listener, error) {
+			return listenUnix(serverUnix.Addr)
+		})
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to start Unix socket DNS server")
+		}
+		serverUnix.Listener = listener
+	}
+
+	// A server that stops serving shuts the others down and fails the process
+	serveErrs := make(chan error, 4)
+	serve := func(name string, server *dns.Server) {
+		if err := server.ActivateAndServe(); err != nil {
+			serveErrs <- fmt.Errorf("%s on `%s`: %w", name, server.Addr, err)
+		}
+	}
+	go serve("UDP DNS server", serverUDP)
+	go serve("TCP DNS server", serverTCP)
+	if serverDoT != nil {
+		go serve("DNS-over-TLS server", serverDoT)
+	}
+	if serverUnix != nil {
+		go serve("Unix socket DNS server", serverUnix)
+	}
+
+	// Serve the static hosts until Docker can be reached, then discover the rest
+	publish(newRegistry(mergeHostsFile(append(mergeZonefile(nil), staticServices()...))))
+	go discoverWithRetry(ctx)
+
+	if config.MetricsAddr != "" {
+		go serveMetrics(ctx)
+	}
+	if config.HealthAddr != "" {
+		go serveHealth(ctx)
+	}
+	if config.DoHAddr != "" {
+		go serveDoH(ctx, certs, newDNSMux(resolver))
+	}
+
+	// Keep the snapshot up to date as containers come and go
+	if config.WatchEvents {
+		for _, host := range dockerHosts() {
+			go watchEvents(ctx, host, refresh)
+		}
+	}
+
+	// Periodically re-discover in case events were missed
+	if config.RefreshInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(config.RefreshInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					refresh()
+				}
+			}
+		}()
+	}
+
+	// Re-discover immediately on SIGHUP, e.g. after changing labels
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				reload()
+			}
+		}
+	}()
+
+	log.Info().Msgf("DNS server started on `%s`", config.Listen)
+
+	// Serve until asked to stop, or until a server fails
+	failed := false
+	select {
+	case <-ctx.Done():
+	case err := <-serveErrs:
+		log.Error().Err(err).Msg("DNS server failed")
+		failed = true
+	}
+	stop()
+	log.Info().Msg("Shutting down...")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := serverUDP.ShutdownContext(shutdownCtx); err != nil {
+		log.Error().Err(err).Msg("Failed to shut down UDP DNS server")
+	}
+	if err := serverTCP.ShutdownContext(shutdownCtx); err != nil {
+		log.Error().Err(err).Msg("Failed to shut down TCP DNS server")
+	}
+	if serverDoT != nil {
+		if err := serverDoT.ShutdownContext(shutdownCtx); err != nil {
+			log.Error().Err(err).Msg("Failed to shut down DNS-over-TLS server")
+		}
+	}
+	if serverUnix != nil {
+		if err := serverUnix.ShutdownContext(shutdownCtx); err != nil {
+			log.Error().Err(err).Msg("Failed to shut down Unix socket DNS server")
+		}
+	}
+	if failed {
+		cancel()
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+)
+
+func TestJitterTTL(t *testing.T) {
+	testConfig(t)
+
+	tests := []struct {
+		name     string
+		jitter   int
+		ttl      uint32
+		limit    uint32
+		min, max uint32
+	}{
+		{"disabled", 0, 3600, math.MaxUint32, 3600, 3600},
+		{"ten percent", 10, 3600, math.MaxUint32, 3240, 3960},
+		{"full range", 100, 100, math.MaxUint32, 1, 200},
+		{"zero stays zero", 50, 0, math.MaxUint32, 0, 0},
+		{"capped by lifetime", 50, 600, 600, 300, 600},
+		{"never below one", 100, 1, math.MaxUint32, 1, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.TTLJitter = tt.jitter
+			seen := make(map[uint32]bool)
+			for range 1000 {
+				ttl := jitterTTL(tt.ttl, tt.limit)
+				if ttl < tt.min || ttl > tt.max {
+					t.Fatalf("jitterTTL(%d, %d) = %d, want within [%d, %d]", tt.ttl, tt.limit, ttl, tt.min, tt.max)
+				}
+				seen[ttl] = true
+			}
+			if tt.min != tt.max && len(seen) < 2 {
+				t.Errorf("jitterTTL(%d, %d) always returned the same TTL", tt.ttl, tt.limit)
+			}
+		})
+	}
+}
+
+func TestServiceLifetime(t *testing.T) {
+	testConfig(t)
+	now := time.Now()
+
+	tests := []struct {
+		name     string
+		service  Service
+		ttl      uint32
+		lifetime uint32
+	}{
+		{"no deadline", Service{RecordTTL: 60}, 60, math.MaxUint32},
+		{"expiring", Service{RecordTTL: 3600, ExpiresAt: now.Add(90 * time.Second)}, 90, 90},
+		{"expired", Service{RecordTTL: 3600, ExpiresAt: now.Add(-time.Second)}, 0, 0},
+		{"leased", Service{RecordTTL: 3600, LeaseEnd: now.Add(120 * time.Second)}, 120, 120},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.service.TTL(now); got != tt.ttl {
+				t.Errorf("TTL = %d, want %d", got, tt.ttl)
+			}
+			if got := tt.service.Lifetime(now); got != tt.lifetime {
+				t.Errorf("Lifetime = %d, want %d", got, tt.lifetime)
+			}
+		})
+	}
+}
+
+func TestContainerSRV(t *testing.T) {
+	testConfig(t)
+
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   []SRVRecord
+	}{
+		{"unset", nil, nil},
+		{"port only", map[string]string{"com.autodns.srv": "_http._tcp=80"}, []SRVRecord{{Service: "_http._tcp", Port: 80}}},
+		{"priority and weight", map[string]string{"com.autodns.srv": "_https._tcp=443:10:5"}, []SRVRecord{{Service: "_https._tcp", Port: 443, Priority: 10, Weight: 5}}},
+		{"priority only", map[string]string{"com.autodns.srv": "_https._tcp=443:10"}, []SRVRecord{{Service: "_https._tcp", Port: 443, Priority: 10}}},
+		{"several", map[string]string{"com.autodns.srv": " _http._tcp=80 , _sip._udp.=5060,"}, []SRVRecord{{Service: "_http._tcp", Port: 80}, {Service: "_sip._udp", Port: 5060}}},
+		{"label defaults", map[string]string{"com.autodns.srv": "_http._tcp=80,_https._tcp=443:1,_sip._udp=5060:2:3", "com.autodns.srv.priority": "10", "com.autodns.srv.weight": "20"}, []SRVRecord{{Service: "_http._tcp", Port: 80, Priority: 10, Weight: 20}, {Service: "_https._tcp", Port: 443, Priority: 1, Weight: 20}, {Service: "_sip._udp", Port: 5060, Priority: 2, Weight: 3}}},
+		{"invalid label defaults", map[string]string{"com.autodns.srv": "_http._tcp=80", "com.autodns.srv.priority": "-1", "com.autodns.srv.weight": "65536"}, []SRVRecord{{Service: "_http._tcp", Port: 80}}},
+		{"invalid entries skipped", map[string]string{"com.autodns.srv": "_http._tcp,http._tcp=80,_a._tcp=0,_b._tcp=70000,_c._tcp=1:2:3:4,_d._tcp=x,_ok._tcp=8080"}, []SRVRecord{{Service: "_ok._tcp", Port: 8080}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := containerSRV(container.Summary{Names: []string{"/app"}, Labels: tt.labels})
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectNetwork(t *testing.T) {
+	tests := []struct {
+		name           string
+		networks       []string
+		label          string
+		defaultNetwork string
+		excludeBridge  bool
+		want           string // "" when none can be picked
+	}{
+		{"only bridge", []string{"bridge"}, "", "bridge", true, "bridge"},
+		{"only a user network", []string{"app_net"}, "", "bridge", true, "app_net"},
+		{"bridge and a user network", []string{"bridge", "app_net"}, "", "bridge", true, "app_net"},
+		{"bridge and a user network, bridge kept", []string{"bridge", "app_net"}, "", "bridge", false, "bridge"},
+		{"bridge and two user networks", []string{"bridge", "app_net", "db_net"}, "", "bridge", true, "bridge"},
+		{"two user networks", []string{"app_net", "db_net"}, "", "bridge", true, ""},
+		{"default user network", []string{"bridge", "app_net", "db_net"}, "", "db_net", true, "db_net"},
+		{"bridge by label", []string{"bridge", "app_net"}, "bridge", "bridge", true, "bridge"},
+		{"label not attached", []string{"bridge"}, "app_net", "bridge", true, ""},
+		{"no network", nil, "", "bridge", true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testConfig(t)
+			config.DefaultNetwork, config.ExcludeBridge = tt.defaultNetwork, tt.excludeBridge
+
+			c := container.Summary{Names: []string{"/app"}, Labels: map[string]string{}, NetworkSettings: &container.NetworkSettingsSummary{Networks: map[string]*network.EndpointSettings{}}}
+			for _, name := range tt.networks {
+				c.NetworkSettings.Networks[name] = &network.EndpointSettings{}
+			}
+			if tt.label != "" {
+				c.Labels["com.autodns.network"] = tt.label
+			}
+
+			got, ok := selectNetwork(c)
+			if ok != (tt.want != "") || got != tt.want {
+				t.Fatalf("got %q, %v, want %q", got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiscoverTraefikNetwork(t *testing.T) {
+	tests := []struct {
+		name     string
+		labels   map[string]string
+		networks []string
+		want     string // The address Traefik is found at, "" if it isn't
+	}{
+		{"single custom network", map[string]string{}, []string{"proxy_net"}, "172.20.0.2"},
+		{"bridge and a custom network", map[string]string{}, []string{"bridge", "proxy_net"}, "172.20.0.2"},
+		{"two custom networks", map[string]string{}, []string{"proxy_net", "web_net"}, ""},
+		{"labelled network", map[string]string{"com.autodns.network": "web_net"}, []string{"proxy_net", "web_net"}, "172.20.0.2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testConfig(t)
+			traefik := testContainer("traefik", "172.20.0.2", tt.labels, tt.networks...)
+			traefik.Image = "traefik:v3.1"
+			newFakeDocker(t, traefik, testContainer("app", "172.20.0.3", map[string]string{}, "proxy_net"))
+
+			instances, err := discoverTraefik(t.Context(), config.DockerHosts[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got string
+			if instance, ok := instances["traefik"]; ok {
+				got = instance.IPAddress.String()
+			}
+			if got != tt.want || len(instances) > 1 {
+				t.Fatalf("found %d instances, traefik at %q, want %q", len(instances), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTraefikRule(t *testing.T) {
+	tests := []struct {
+		name      string
+		rule      string
+		hosts     []string
+		hasRegexp bool
+	}{
+		{"single host", "Host(`app.local`)", []string{"app.local"}, false},
+		{"or of hosts", "Host(`a.local`) || Host(`b.local`)", []string{"a.local", "b.local"}, false},
+		{"several hosts in one matcher", "Host(`a.local`, `b.local`)", []string{"a.local", "b.local"}, false},
+		{"quoted host", `Host("app.local")`, []string{"app.local"}, false},
+		{"with a path", "Host(`a.local`) || (Host(`b.local`) && PathPrefix(`/api`))", []string{"a.local", "b.local"}, false},
+		{"host regexp only", "HostRegexp(`{sub:[a-z]+}.local`)", nil, true},
+		{"host and host regexp", "Host(`a.local`) || HostRegexp(`.+\\.local`)", []string{"a.local"}, true},
+		{"no host", "PathPrefix(`/api`)", nil, false},
+		{"empty host", "Host(` `)", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts, hasRegexp := parseTraefikRule(tt.rule)
+			if !slices.Equal(hosts, tt.hosts) || hasRegexp != tt.hasRegexp {
+				t.Errorf("parseTraefikRule(%q) = %q, %v, want %q, %v", tt.rule, hosts, hasRegexp, tt.hosts, tt.hasRegexp)
+			}
+		})
+	}
+}
+
+func TestDiscoverTraefikOrRule(t *testing.T) {
+	testConfig(t)
+	traefik := testContainer("traefik", "172.20.0.2", map[string]string{}, "proxy_net")
+	traefik.Image = "traefik:v3.1"
+	app := testContainer("app", "172.20.0.3", map[string]string{
+		"traefik.http.routers.app.rule": "Host(`a.local`) || (Host(`b.local`) && PathPrefix(`/api`))",
+	}, "proxy_net")
+	newFakeDocker(t, traefik, app)
+
+	services, err := discover(t.Context(), config.DockerHosts[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, service := range services {
+		if service.ContainerName == "app" {
+			got = append(got, service.HostnameLabel+"="+service.IPAddress.String())
+		}
+	}
+	slices.Sort(got)
+	if want := []string{"a.local=172.20.0.2", "b.local=172.20.0.2"}; !slices.Equal(got, want) {
+		t.Errorf("services = %q, want %q", got, want)
+	}
+}
+
+func TestValidHostname(t *testing.T) {
+	tests := []struct {
+		hostname string
+		want     bool
+	}{
+		{"app.local", true},
+		{"app", true},
+		{"my-app_1.local", true},
+		{"*.apps.local", true},
+		{"xn--bcher-kva.local", true},
+		{"", false},
+		{"app..local", false},
+		{".app.local", false},
+		{"app.*.local", false},
+		{"**.local", false},
+		{"app local", false},
+		{"app\n.local", false},
+		{"app\x00.local", false},
+		{"app/../local", false},
+		{"App.local", false}, // Qualified names are lowercase
+		{strings.Repeat("a", 64) + ".local", false},
+		{strings.Repeat("a", 63) + ".local", true},
+		{strings.Repeat("a.", 127), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.hostname, func(t *testing.T) {
+			if got := validHostname(tt.hostname); got != tt.want {
+				t.Errorf("validHostname(%q) = %v, want %v", tt.hostname, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitHostnames(t *testing.T) {
+	tests := []struct {
+		name   string
+		label  string
+		domain string
+		want   []string
+	}{
+		{"single", "app.local", "", []string{"app.local"}},
+		{"several", "a.local, b.local,,c.local", "", []string{"a.local", "b.local", "c.local"}},
+		{"qualified", "App, db.other", "local", []string{"app.local", "db.other"}},
+		{"trailing dot", "app.local.", "", []string{"app.local"}},
+		{"invalid skipped", "a.local,bad name.local,c\t.local,b.local", "", []string{"a.local", "b.local"}},
+		{"all invalid", "bad name", "", nil},
+		{"empty", "", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testConfig(t)
+			config.Domain = tt.domain
+			if got := splitHostnames(container.Summary{Names: []string{"/app"}}, tt.label); !slices.Equal(got, tt.want) {
+				t.Errorf("splitHostnames(%q) = %q, want %q", tt.label, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLabelConfig(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		err   bool
+	}{
+		{"full", `{"hostname":"app.local","ttl":60,"weight":5,"ips":["10.0.0.5","fd00::5"],"type":"a"}`, false},
+		{"hostname only", `{"hostname":"a.local,b.local"}`, false},
+		{"cname", `{"hostname":"alias.local","type":"CNAME","target":"app.local"}`, false},
+		{"not JSON", `hostname=app.local`, true},
+		{"unknown field", `{"hostname":"app.local","port":80}`, true},
+		{"trailing data", `{"hostname":"app.local"} {}`, true},
+		{"unknown type", `{"hostname":"app.local","type":"MX"}`, true},
+		{"cname without target", `{"hostname":"alias.local","type":"CNAME"}`, true},
+		{"cname with addresses", `{"type":"CNAME","target":"app.local","ips":["10.0.0.5"]}`, true},
+		{"target without cname", `{"target":"app.local"}`, true},
+		{"invalid address", `{"ips":["10.0.0.500"]}`, true},
+		{"two IPv4 addresses", `{"ips":["10.0.0.5","10.0.0.6"]}`, true},
+		{"zero weight", `{"weight":0}`, true},
+		{"negative TTL", `{"ttl":-1}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseLabelConfig(tt.value); (err != nil) != tt.err {
+				t.Errorf("parseLabelConfig(%s) error = %v, want error %v", tt.value, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestDiscoverLabelConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   []string // hostname=IPv4,IPv6/TTL of the container's services
+	}{
+		{
+			"overrides labels",
+			map[string]string{"com.autodns.hostname": "old.local", "com.autodns.ttl": "300", "com.autodns.config": `{"hostname":"app.local","ttl":60}`},
+			[]string{"app.local=172.20.0.3,<nil>/60"},
+		},
+		{
+			"keeps unset fields",
+			map[string]string{"com.autodns.hostname": "app.local", "com.autodns.ttl": "300", "com.autodns.config": `{"ips":["10.0.0.5","fd00::5"]}`},
+			[]string{"app.local=10.0.0.5,fd00::5/300"},
+		},
+		{
+			"single family",
+			map[string]string{"com.autodns.config": `{"hostname":"app.local","ips":["10.0.0.5","fd00::5"],"type":"AAAA"}`},
+			[]string{"app.local=<nil>,fd00::5/60"},
+		},
+		{
+			"invalid JSON skips the container",
+			map[string]string{"com.autodns.hostname": "app.local", "com.autodns.config": `{"hostname":`},
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testConfig(t)
+			config.TTL = 60
+			newFakeDocker(t, testContainer("app", "172.20.0.3", tt.labels, "app_net"))
+
+			services, err := discover(t.Context(), config.DockerHosts[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, service := range services {
+				got = append(got, fmt.Sprintf("%s=%v,%v/%d", service.HostnameLabel, service.IPAddress, service.IPAddress6, service.RecordTTL))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("services = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/rs/zerolog/log"
+)
+
+// maintenanceTTL is the TTL of maintenance answers, short so clients come back soon after.
+const maintenanceTTL = 30
+
+// maintenanceIP holds the address of `AUTODNS_MAINTENANCE_IP`, nil outside maintenance.
+var maintenanceIP atomic.Pointer[net.IP]
+
+// setMaintenance enters maintenance mode with the address `value`, or leaves it if
+// `value` is "", logging whenever the mode changes.
+func setMaintenance(value string) {
+	ip := net.ParseIP(value)
+	previous := maintenanceIP.Load()
+	switch {
+	case ip == nil && previous != nil:
+		log.Info().Msg("Maintenance mode ended, answering from discovered services again")
+	case ip != nil && (previous == nil || !previous.Equal(ip)):
+		log.Warn().Msgf("Maintenance mode active, answering every in-zone address query with `%s`", ip)
+	}
+
+	if ip == nil {
+		maintenanceIP.Store(nil)
+		return
+	}
+	maintenanceIP.Store(&ip)
+}
+
+// maintenance returns the maintenance address, or nil outside maintenance.
+func maintenance() net.IP {
+	if ip := maintenanceIP.Load(); ip != nil {
+		return *ip
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	queriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "autodns_queries_total",
+		Help: "Total number of DNS queries received, by query type.",
+	}, []string{"qtype"})
+
+	responsesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "autodns_responses_total",
+		Help: "Total number of DNS responses sent, by response code.",
+	}, []string{"rcode"})
+
+	servicesGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "autodns_services",
+		Help: "Number of hostnames currently registered from discovery.",
+	})
+
+	upstreamDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "autodns_upstream_duration_seconds",
+		Help:    "Latency of queries forwarded to the upstream resolver.",
+		Buckets: prometheus.DefBuckets,
+	})
+)
+
+// metricsRegisterer registers every collector with the instance identity as a constant
+// label. It is `autodns_instance` rather than `instance` so it doesn't clash with the
+// scrape target label Prometheus adds itself.
+var metricsRegisterer prometheus.Registerer = prometheus.DefaultRegisterer
+
+// initMetrics registers the collectors, labelled with this instance's identity.
+func initMetrics() {
+	metricsRegisterer = prometheus.WrapRegistererWith(prometheus.Labels{"autodns_instance": config.InstanceID}, prometheus.DefaultRegisterer)
+	metricsRegisterer.MustRegister(queriesTotal, responsesTotal, servicesGauge, upstreamDuration)
+}
+
+// registerTCPMetrics exposes the connection counts of the limited TCP listener.
+func registerTCPMetrics(l *limitListener) {
+	metricsRegisterer.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "autodns_tcp_connections",
+			Help: "Number of currently open TCP connections.",
+		}, func() float64 { return float64(l.Active()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "autodns_tcp_connections_rejected_total",
+			Help: "Total number of TCP connections rejected over the connection limit.",
+		}, func() float64 { return float64(l.Rejected()) }),
+	)
+}
+
+// metricsWriter counts the response codes of the messages written through it, and
+// remembers the last one for the access log.
+type metricsWriter struct {
+	dns.ResponseWriter
+	rcode int
+}
+
+func (w *metricsWriter) WriteMsg(m *dns.Msg) error {
+	responsesTotal.WithLabelValues(dns.RcodeToString[m.Rcode]).Inc()
+	w.rcode = m.Rcode
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// serveMetrics exposes the Prometheus metrics on `AUTODNS_METRICS_ADDR` until `ctx` is cancelled.
+func serveMetrics(ctx context.Context) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/services", handleServices)
+
+	server := &http.Server{
+		Addr:              config.MetricsAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	log.Info().Msgf("Serving metrics on `%s`", config.MetricsAddr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Error().Err(err).Msgf("Failed to start metrics server on `%s`", config.MetricsAddr)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+// MXRecord describes a mail exchanger of a hostname.
+type MXRecord struct {
+	Preference uint16
+	Target     string
+}
+
+// containerMX parses the container's comma-separated `com.autodns.mx` label, whose
+// entries look like `10 mail.local`.
+func containerMX(container container.Summary) []MXRecord {
+	var records []MXRecord
+	for _, entry := range strings.Split(container.Labels[labelKey("mx")], ",") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			log.Warn().Msgf("Container `%s` has an invalid MX entry %q, skipping", containerName(container), entry)
+			continue
+		}
+
+		preference, err := strconv.ParseUint(fields[0], 10, 16)
+		if err != nil {
+			log.Warn().Msgf("Container `%s` has an invalid MX priority `%s`, skipping", containerName(container), fields[0])
+			continue
+		}
+		target := qualifyHostname(fields[1])
+		if !validHostname(target) {
+			log.Warn().Msgf("Container `%s` has an invalid MX target %q, skipping", containerName(container), fields[1])
+			continue
+		}
+
+		records = append(records, MXRecord{Preference: uint16(preference), Target: target + "."})
+	}
+	return records
+}
+
+// makeMXResponse builds an MX record for each mail exchanger of the live services.
+func makeMXResponse(h string, services []Service, now time.Time) *dns.Msg {
+	log.Debug().Msgf("Creating DNS MX response for: %s", h)
+
+	var records []dns.RR
+	for _, service := range liveServices(services, now) {
+		for _, record := range service.MX {
+			records = append(records, &dns.MX{
+				Hdr: dns.RR_Header{
+					Name:   h,
+					Rrtype: dns.TypeMX,
+					Class:  dns.ClassINET,
+					Ttl:    service.TTL(now),
+				},
+				Preference: record.Preference,
+				Mx:         record.Target,
+			})
+		}
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(&dns.Msg{})
+	m.Authoritative = true
+	m.RecursionAvailable = true
+	m.Answer = records
+
+	return m
+}
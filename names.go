@@ -0,0 +1,110 @@
+package main
+
+import (
+	"maps"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/rs/zerolog/log"
+)
+
+// nameZoneServices registers the container as `<name>.<zone>` and `<short ID>.<zone>`
+// under `AUTODNS_NAME_ZONE`, whatever its labels, at its address on the network it
+// would otherwise be served on. Containers without a clear network are left out quietly.
+func nameZoneServices(container container.Summary) []Service {
+	var networks map[string]*network.EndpointSettings
+	if container.NetworkSettings != nil {
+		networks = container.NetworkSettings.Networks
+	}
+
+	endpoint, ok := networks[container.Labels[labelKey("network")]]
+	if !ok {
+		networks = candidateNetworks(networks)
+		endpoint, ok = networks[config.DefaultNetwork]
+	}
+	if !ok && len(networks) == 1 {
+		for _, only := range networks {
+			endpoint, ok = only, true
+		}
+	}
+	if !ok || endpoint == nil || (endpoint.IPAddress == "" && endpoint.GlobalIPv6Address == "") {
+		return nil
+	}
+
+	zone := strings.TrimSuffix(config.NameZone, ".")
+	var services []Service
+	for _, label := range []string{sanitizeLabel(containerName(container)), shortID(container.ID)} {
+		hostname := label + "." + zone
+		if label == "" || !validHostname(hostname) {
+			continue
+		}
+		services = append(services, Service{
+			ContainerName: containerName(container),
+			HostnameLabel: hostname,
+			IPAddress:     net.ParseIP(endpoint.IPAddress),
+			IPAddress6:    net.ParseIP(endpoint.GlobalIPv6Address),
+			RecordTTL:     config.TTL,
+		})
+	}
+	return services
+}
+
+// networkAliasServices registers the container's `--network-alias` names, qualified
+// with `AUTODNS_DOMAIN`, at its address on the network each alias belongs to. The
+// short ID Docker adds as an alias of its own is left out.
+func networkAliasServices(container container.Summary) []Service {
+	if container.NetworkSettings == nil {
+		return nil
+	}
+
+	var services []Service
+	for _, name := range slices.Sorted(maps.Keys(container.NetworkSettings.Networks)) {
+		endpoint := container.NetworkSettings.Networks[name]
+		if endpoint == nil || (endpoint.IPAddress == "" && endpoint.GlobalIPv6Address == "") {
+			continue
+		}
+		for _, alias := range endpoint.Aliases {
+			if alias == "" || strings.HasPrefix(container.ID, alias) {
+				continue
+			}
+			hostname := qualifyHostname(alias)
+			if !validHostname(hostname) {
+				log.Warn().Msgf("Container `%s` has an invalid network alias %q on `%s`, skipping", containerName(container), alias, name)
+				continue
+			}
+			services = append(services, Service{
+				ContainerName: containerName(container),
+				HostnameLabel: hostname,
+				IPAddress:     net.ParseIP(endpoint.IPAddress),
+				IPAddress6:    net.ParseIP(endpoint.GlobalIPv6Address),
+				RecordTTL:     containerTTL(container),
+				ExpiresAt:     containerExpiry(container),
+				Network:       name,
+				NetworkAlias:  true,
+			})
+		}
+	}
+	return services
+}
+
+// sanitizeLabel turns a container name into a DNS label, e.g. `my_app.1` into `my-app-1`.
+func sanitizeLabel(name string) string {
+	label := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		}
+		return '-'
+	}, name)
+	return strings.Trim(label[:min(len(label), 63)], "-")
+}
+
+// shortID returns the 12-character form of a container ID, as `docker ps` shows it.
+func shortID(id string) string {
+	return id[:min(len(id), 12)]
+}
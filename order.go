@@ -0,0 +1,154 @@
+package main
+
+import (
+	"cmp"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// answerOrder orders the addresses of an A or AAAA answer for `name`. `weights` holds
+// the `com.autodns.weight` of each address, and `client` is nil when the query didn't
+// come from a client, as for glue records.
+type answerOrder interface {
+	Order(name string, ips []net.IP, weights []uint, client net.IP)
+}
+
+// answerOrders maps the values of `AUTODNS_ORDER` to their strategy.
+var answerOrders = map[string]answerOrder{
+	"stable":    stableOrder{},
+	"random":    randomOrder{},
+	"affinity":  affinityOrder{},
+	"proximity": proximityOrder{},
+	"rotate":    rotateOrder{},
+}
+
+// stableOrder keeps the addresses in registry order.
+type stableOrder struct{}
+
+func (stableOrder) Order(string, []net.IP, []uint, net.IP) {}
+
+// randomOrder shuffles the addresses by weight on every query.
+type randomOrder struct{}
+
+func (randomOrder) Order(_ string, ips []net.IP, weights []uint, _ net.IP) {
+	weightedShuffle(ips, weights, func(net.IP) float64 { return rand.ExpFloat64() })
+}
+
+// affinityOrder shuffles the addresses by weight, the same way every time for a given
+// client, so it keeps reaching the same backend as long as the addresses don't change.
+type affinityOrder struct{}
+
+func (affinityOrder) Order(_ string, ips []net.IP, weights []uint, client net.IP) {
+	weightedShuffle(ips, weights, func(ip net.IP) float64 {
+		h := fnv.New64a()
+		h.Write(client.To16())
+		h.Write(ip.To16())
+
+		// An exponential variate from a uniform one in (0, 1] derived from the hash. FNV
+		// barely spreads the last bytes written into the high bits, so mix them first.
+		u := float64(mix64(h.Sum64())>>11+1) / (1 << 53)
+		return -math.Log(u)
+	})
+}
+
+// proximityOrder puts the addresses sharing the longest prefix with the client first,
+// so clients reach a backend on their own subnet. Addresses as close as each other are
+// shuffled by weight, and all of them without a client.
+type proximityOrder struct{}
+
+func (proximityOrder) Order(name string, ips []net.IP, weights []uint, client net.IP) {
+	randomOrder{}.Order(name, ips, weights, client)
+	if client == nil {
+		return
+	}
+	slices.SortStableFunc(ips, func(a, b net.IP) int {
+		return cmp.Compare(commonPrefix(client, b), commonPrefix(client, a))
+	})
+}
+
+// rotationKey identifies the counter of rotateOrder for the A or AAAA answers of a name.
+type rotationKey struct {
+	name  string
+	qtype uint16
+}
+
+// rotations holds the query counter of each rotationKey, an *atomic.Uint64.
+var rotations sync.Map
+
+// pruneRotations drops the counters of names `r` doesn't hold, once it is published.
+func pruneRotations(r *Registry) {
+	rotations.Range(func(key, _ any) bool {
+		if _, ok := r.services[key.(rotationKey).name]; !ok {
+			rotations.Delete(key)
+		}
+		return true
+	})
+}
+
+// rotateOrder rotates the addresses by a counter of the client queries for the name and
+// family, so over any run of queries each address leads its share of answers by weight:
+// with weights 3 and 1, the first leads three answers in a row, then the second one.
+// Addresses not answered to a client, as glue or in zone transfers, keep registry order
+// and don't advance the counter.
+type rotateOrder struct{}
+
+func (rotateOrder) Order(name string, ips []net.IP, weights []uint, client net.IP) {
+	if len(ips) < 2 || client == nil {
+		return
+	}
+	key := rotationKey{name, dns.TypeA}
+	if ips[0].To4() == nil {
+		key.qtype = dns.TypeAAAA
+	}
+	counter, _ := rotations.LoadOrStore(key, new(atomic.Uint64))
+	turn := counter.(*atomic.Uint64).Add(1) - 1
+
+	var total uint64
+	for _, weight := range weights {
+		total += uint64(weight)
+	}
+	turn %= total
+
+	start := 0
+	for turn >= uint64(weights[start]) {
+		turn -= uint64(weights[start])
+		start++
+	}
+	copy(ips, slices.Concat(ips[start:], ips[:start]))
+}
+
+// commonPrefix returns the number of leading bits `a` and `b` share, 0 if they're of
+// different families.
+func commonPrefix(a, b net.IP) int {
+	if a4, b4 := a.To4(), b.To4(); (a4 == nil) != (b4 == nil) {
+		return 0
+	} else if a4 != nil {
+		a, b = a4, b4
+	}
+
+	n := 0
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			return n + bits.LeadingZeros8(x)
+		}
+		n += 8
+	}
+	return n
+}
+
+// mix64 is the splitmix64 finalizer, spreading every bit of `x` over the whole result.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	return x ^ x>>31
+}
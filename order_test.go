@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// testIPs returns `n` distinct addresses, all of weight 1.
+func testIPs(n int) ([]net.IP, []uint) {
+	ips, weights := make([]net.IP, n), make([]uint, n)
+	for i := range n {
+		ips[i], weights[i] = net.IPv4(10, 0, 0, byte(i+1)), 1
+	}
+	return ips, weights
+}
+
+// ordered returns the order `strategy` gives a fresh copy of `n` test addresses.
+func ordered(strategy answerOrder, n int, client net.IP) string {
+	ips, weights := testIPs(n)
+	strategy.Order("app.local.", ips, weights, client)
+	return fmt.Sprint(ips)
+}
+
+func TestAnswerOrderStability(t *testing.T) {
+	// Glue and zone transfers order addresses without a client
+	clients := []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("2001:db8::1"), nil}
+
+	tests := []struct {
+		name      string
+		strategy  answerOrder
+		stable    bool // Whether a client always gets the same order
+		perClient bool // Whether the order depends on the client
+	}{
+		{"stable", stableOrder{}, true, false},
+		{"random", randomOrder{}, false, false},
+		{"affinity", affinityOrder{}, true, true},
+		{"rotate", rotateOrder{}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen := make(map[string]bool)
+			for _, client := range clients {
+				first := ordered(tt.strategy, 8, client)
+				seen[first] = true
+
+				varied := false
+				for range 50 {
+					if ordered(tt.strategy, 8, client) != first {
+						varied = true
+					}
+				}
+				if tt.strategy == (rotateOrder{}) && client == nil {
+					if varied {
+						t.Errorf("order varied without a client")
+					}
+					continue
+				}
+				if varied == tt.stable {
+					t.Errorf("client %v: order varied = %v, want %v", client, varied, !tt.stable)
+				}
+			}
+			if tt.stable && (len(seen) > 1) != tt.perClient {
+				t.Errorf("%d distinct orders across %d clients, per-client = %v", len(seen), len(clients), tt.perClient)
+			}
+		})
+	}
+}
+
+func TestAnswerOrderWeights(t *testing.T) {
+	// With weights 9 and 1, the heavier address comes first about 90% of the time,
+	// across queries for random and across clients for affinity
+	const n = 4000
+	for name, strategy := range map[string]answerOrder{"random": randomOrder{}, "affinity": affinityOrder{}} {
+		first := 0
+		for i := range n {
+			ips := []net.IP{net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)}
+			strategy.Order("app.local.", ips, []uint{9, 1}, net.IPv4(192, 0, byte(i>>8), byte(i)))
+			if ips[0].Equal(net.IPv4(10, 0, 0, 1)) {
+				first++
+			}
+		}
+		if share := float64(first) / n; share < 0.85 || share > 0.95 {
+			t.Errorf("%s: heavier address first %.1f%% of the time, want about 90%%", name, share*100)
+		}
+	}
+}
+
+func TestAnswerOrderPermutes(t *testing.T) {
+	for name, strategy := range answerOrders {
+		ips, weights := testIPs(8)
+		strategy.Order("app.local.", ips, weights, net.ParseIP("192.0.2.1"))
+
+		want, _ := testIPs(8)
+		slices.SortFunc(ips, func(a, b net.IP) int { return slices.Compare(a, b) })
+		if fmt.Sprint(ips) != fmt.Sprint(want) {
+			t.Errorf("%s: got %v, want a permutation of %v", name, ips, want)
+		}
+	}
+}
+
+func TestProximityOrder(t *testing.T) {
+	// Backends spread across two subnets, two on each
+	backends := []string{"10.1.0.5", "10.2.0.5", "10.1.0.6", "10.2.0.6", "2001:db8::5"}
+
+	tests := []struct {
+		name   string
+		client net.IP
+		first  string // The subnet the first two answers must be on
+	}{
+		{"client on the first subnet", net.ParseIP("10.1.0.100"), "10.1.0."},
+		{"client on the second subnet", net.ParseIP("10.2.7.1"), "10.2.0."},
+		{"IPv4-mapped client", net.ParseIP("::ffff:10.2.0.1"), "10.2.0."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			leaders := make(map[string]bool)
+			for range 100 {
+				ips := make([]net.IP, len(backends))
+				for i, backend := range backends {
+					ips[i] = net.ParseIP(backend)
+				}
+				proximityOrder{}.Order("app.local.", ips, []uint{1, 1, 1, 1, 1}, tt.client)
+
+				for _, ip := range ips[:2] {
+					if !strings.HasPrefix(ip.String(), tt.first) {
+						t.Fatalf("got %v, want the %s addresses first", ips, tt.first)
+					}
+				}
+				if ips[len(ips)-1].To4() != nil {
+					t.Fatalf("got %v, want the IPv6 address last", ips)
+				}
+				leaders[ips[0].String()] = true
+			}
+			// Equally close addresses still take turns
+			if len(leaders) != 2 {
+				t.Errorf("%d addresses led, want both on the client's subnet", len(leaders))
+			}
+		})
+	}
+}
+
+func TestCommonPrefix(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"10.0.0.1", "10.0.0.1", 32},
+		{"10.0.0.1", "10.0.0.2", 30},
+		{"10.0.0.1", "10.0.1.1", 23},
+		{"10.0.0.1", "192.168.0.1", 0},
+		{"10.0.0.1", "::ffff:10.0.0.1", 32},
+		{"10.0.0.1", "2001:db8::1", 0},
+		{"2001:db8::1", "2001:db8::1", 128},
+		{"2001:db8::1", "2001:db9::1", 31},
+	}
+	for _, tt := range tests {
+		if got := commonPrefix(net.ParseIP(tt.a), net.ParseIP(tt.b)); got != tt.want {
+			t.Errorf("commonPrefix(%s, %s) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestRotateOrder(t *testing.T) {
+	rotations.Clear()
+	tests := []struct {
+		name    string
+		weights []uint
+		leaders string // The leading address of each query in turn, by index
+	}{
+		{"single", []uint{1}, "0000"},
+		{"equal weights", []uint{1, 1, 1, 1}, "01230123"},
+		{"weighted", []uint{3, 1}, "00010001"},
+		{"heavier last", []uint{1, 2, 1}, "01120112"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := tt.name + ".local."
+			var leaders strings.Builder
+			for range len(tt.leaders) {
+				ips, _ := testIPs(len(tt.weights))
+				rotateOrder{}.Order(name, ips, tt.weights, net.ParseIP("192.0.2.1"))
+				fmt.Fprint(&leaders, ips[0][15]-1)
+
+				// Rotated, not shuffled
+				for i := range ips {
+					if next := ips[(i+1)%len(ips)][15]; next != ips[i][15]%byte(len(ips))+1 {
+						t.Fatalf("got %v, want a rotation of the addresses", ips)
+					}
+				}
+			}
+			if got := leaders.String(); got != tt.leaders {
+				t.Fatalf("leaders = %s, want %s", got, tt.leaders)
+			}
+		})
+	}
+}
+
+func TestRotateOrderPerName(t *testing.T) {
+	rotations.Clear()
+	lead := func(name string) string {
+		ips, weights := testIPs(2)
+		rotateOrder{}.Order(name, ips, weights, net.ParseIP("192.0.2.1"))
+		return ips[0].String()
+	}
+	first := lead("a.rotate.local.")
+	if lead("b.rotate.local.") != first {
+		t.Error("another name shares the counter of the first")
+	}
+	if lead("a.rotate.local.") == first {
+		t.Error("the name didn't rotate on its second query")
+	}
+}
+
+func TestPruneRotations(t *testing.T) {
+	rotations.Clear()
+	client := net.ParseIP("192.0.2.1")
+	for _, name := range []string{"kept.local.", "gone.local."} {
+		ips, weights := testIPs(2)
+		rotateOrder{}.Order(name, ips, weights, client)
+	}
+
+	pruneRotations(newRegistry([]Service{{ContainerName: "kept", HostnameLabel: "kept.local", IPAddress: net.ParseIP("10.0.0.1")}}))
+	for name, want := range map[string]bool{"kept.local.": true, "gone.local.": false} {
+		if _, ok := rotations.Load(rotationKey{name, dns.TypeA}); ok != want {
+			t.Errorf("counter of %s kept = %v, want %v", name, ok, want)
+		}
+	}
+}
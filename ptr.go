@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+// reverseName returns the in-addr.arpa or ip6.arpa name of the address `ip`, or "" if
+// it isn't one.
+func reverseName(ip string) string {
+	name, err := dns.ReverseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+// makePTRResponse builds a PTR record pointing `h` at each live service's hostname.
+func makePTRResponse(h string, services []Service, now time.Time) *dns.Msg {
+	log.Debug().Msgf("Creating DNS PTR response for: %s", h)
+
+	records := make([]dns.RR, 0, len(services))
+	for _, service := range liveServices(services, now) {
+		records = append(records, &dns.PTR{
+			Hdr: dns.RR_Header{
+				Name:   h,
+				Rrtype: dns.TypePTR,
+				Class:  dns.ClassINET,
+				Ttl:    service.TTL(now),
+			},
+			Ptr: dns.Fqdn(service.HostnameLabel),
+		})
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(&dns.Msg{})
+	m.Authoritative = true
+	m.RecursionAvailable = true
+	m.Answer = records
+
+	return m
+}
+
+// isReverseName reports whether `name` lies in one of the reverse lookup zones.
+func isReverseName(name string) bool {
+	name = strings.ToLower(name)
+	return strings.HasSuffix(name, ".in-addr.arpa.") || strings.HasSuffix(name, ".ip6.arpa.")
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// rateLimitIdle is how long a client must stay quiet before its bucket is forgotten
+const rateLimitIdle = time.Minute
+
+// rateLimiter hands out a token bucket per client IP, refilled at `rate` tokens per
+// second up to `burst`. Buckets of idle clients are evicted to bound memory.
+type rateLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens   float64
+	last     time.Time // When tokens was last refilled
+	loggedAt time.Time // When the client was last logged as limited
+	dropped  int       // Queries dropped since then
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	return &rateLimiter{
+		rate:      rate,
+		burst:     max(rate, 1),
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow takes a token from the bucket of the client at `addr`, reporting whether it had one.
+func (l *rateLimiter) Allow(addr net.Addr) bool {
+	ip := addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) > rateLimitIdle {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[ip] = b
+	}
+
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*l.rate, l.burst)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true
+	}
+
+	// Log at most once a minute per client, with how many queries were dropped
+	b.dropped++
+	if now.Sub(b.loggedAt) > time.Minute {
+		log.Warn().Msgf("Client %s exceeds the rate limit of %g queries/s, refused %d queries", ip, l.rate, b.dropped)
+		b.loggedAt = now
+		b.dropped = 0
+	}
+	return false
+}
+
+// sweep forgets clients idle for longer than rateLimitIdle, whose buckets are full again anyway.
+func (l *rateLimiter) sweep(now time.Time) {
+	for ip, b := range l.buckets {
+		if now.Sub(b.last) > rateLimitIdle {
+			delete(l.buckets, ip)
+		}
+	}
+	l.lastSweep = now
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+// containerRecords parses the container's verbatim records, from its `com.autodns.record`
+// label and any `com.autodns.record.<name>` ones, each holding a type and its data like
+// `TXT "v=spf1 -all"`, and its `com.autodns.https` label holding the data of an HTTPS
+// record. They are parsed under the root name, which is replaced by the queried name
+// when served.
+func containerRecords(container container.Summary) []dns.RR {
+	var records []dns.RR
+	for _, label := range slices.Sorted(maps.Keys(container.Labels)) {
+		if label != labelKey("record") && !strings.HasPrefix(label, labelKey("record")+".") {
+			continue
+		}
+		value := container.Labels[label]
+
+		rr, err := dns.NewRR(". " + value)
+		if err != nil || rr == nil {
+			log.Warn().Err(err).Msgf("Container `%s` has an invalid record %q in `%s`, skipping", containerName(container), value, label)
+			continue
+		}
+		if rr.Header().Rrtype == dns.TypeCNAME {
+			log.Warn().Msgf("Container `%s` has a CNAME record in `%s`, use `%s` instead, skipping", containerName(container), label, labelKey("cname"))
+			continue
+		}
+		records = append(records, rr)
+	}
+
+	// HTTPS service bindings have a label of their own, e.g. `1 . alpn=h3,h2 port=443`
+	if value, ok := container.Labels[labelKey("https")]; ok && value != "" {
+		if rr, err := dns.NewRR(". HTTPS " + value); err != nil || rr == nil {
+			log.Warn().Err(err).Msgf("Container `%s` has an invalid HTTPS record %q, skipping", containerName(container), value)
+		} else {
+			records = append(records, rr)
+		}
+	}
+	return records
+}
+
+// rawRecords returns the verbatim records of the live services with type `qtype`, or
+// of every type for ANY, named `h`.
+func rawRecords(h string, services []Service, qtype uint16, now time.Time) []dns.RR {
+	var records []dns.RR
+	for i := range services {
+		service := &services[i]
+		if len(service.Records) == 0 || service.Expired(now) {
+			continue
+		}
+		for _, record := range service.Records {
+			if qtype != dns.TypeANY && record.Header().Rrtype != qtype {
+				continue
+			}
+			rr := dns.Copy(record)
+			rr.Header().Name = h
+			rr.Header().Ttl = service.TTL(now)
+			records = append(records, rr)
+		}
+	}
+	return records
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+// Registry is an immutable snapshot of the records built from one discovery run.
+// It is never modified once published, so readers need no locking.
+type Registry struct {
+	services map[string][]Service
+	srv      map[string][]SRVRecord
+	ptr      map[string][]Service // Reverse names of each address, for PTR queries
+	serial   uint32               // SOA serial, bumped whenever the records change
+}
+
+// registry holds the current snapshot. Discovery builds a fresh Registry and swaps it
+// in with a single store, so queries see either the old or the new one, never a mix.
+var registry atomic.Pointer[Registry]
+
+// refreshMu serializes refreshes, so the event watcher and the periodic refresh
+// never publish snapshots out of order.
+var refreshMu sync.Mutex
+
+// discoveredOnce is set once a discovery run has succeeded, as opposed to serving only
+// the static hosts published at startup.
+var discoveredOnce atomic.Bool
+
+// refresh re-runs discovery and publishes the result as the new snapshot. If
+// discovery fails, the previous snapshot stays in place.
+func refresh() {
+	if err := tryRefresh(); err != nil {
+		log.Error().Err(err).Msg("Failed to discover services, keeping the previous ones")
+	}
+}
+
+// reload re-reads the zone and hosts files and the maintenance address, and re-discovers
+// on demand, logging the number of hostnames before and after.
+func reload() {
+	log.Info().Msgf("Reloading services, %d hostnames currently registered", registry.Load().Len())
+	if cfg, err := loadConfig(); err != nil {
+		log.Error().Err(err).Msg("Failed to reload configuration, keeping the maintenance mode as is")
+	} else {
+		setMaintenance(cfg.MaintenanceIP)
+	}
+	if config.Zonefile != "" {
+		if err := loadZonefile(); err != nil {
+			log.Error().Err(err).Msg("Failed to reload zone file, keeping its previous records")
+		}
+	}
+	if config.HostsFile != "" {
+		if err := loadHostsFile(); err != nil {
+			log.Error().Err(err).Msg("Failed to reload hosts file, keeping its previous hosts")
+		}
+	}
+	refresh()
+	log.Info().Msgf("Reloaded services, %d hostnames now registered", registry.Load().Len())
+}
+
+// tryRefresh re-runs discovery and publishes the result as the new snapshot,
+// logging how many hostnames changed compared to the previous one.
+func tryRefresh() error {
+	refreshMu.Lock()
+	defer refreshMu.Unlock()
+
+	services, err := discoverAll()
+	if err != nil {
+		return err
+	}
+	if len(services) == 0 {
+		log.Warn().Msg("No services discovered, DNS server will not respond to queries")
+	}
+
+	next := newRegistry(services)
+	previous := publish(next)
+	discoveredOnce.Store(true)
+
+	if previous != nil {
+		added, removed, changed := next.diff(previous)
+		log.Info().Msgf("Refreshed services: %d added, %d removed, %d changed", len(added), len(removed), len(changed))
+		if config.WebhookURL != "" && len(added)+len(removed)+len(changed) > 0 {
+			go notifyWebhook(webhookEvent{Serial: next.Serial(), Added: added, Removed: removed, Changed: changed})
+		}
+	}
+	return nil
+}
+
+// discoverWithRetry runs the first discovery, retrying with exponential backoff up to
+// `AUTODNS_DISCOVERY_MAX_BACKOFF` between attempts while Docker can't be reached.
+func discoverWithRetry(ctx context.Context) {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		err := tryRefresh()
+		if err == nil {
+			retryWhileEmpty(ctx)
+			return
+		}
+
+		if config.DiscoveryMaxBackoff > 0 {
+			backoff = min(backoff, config.DiscoveryMaxBackoff)
+		}
+		log.Warn().Err(err).Msgf("Discovery attempt %d failed, retrying in %s", attempt, backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// retryWhileEmpty re-runs discovery every `AUTODNS_EMPTY_RETRY_INTERVAL` until it finds
+// a container, so one started after AutoDNS is served even without event watching.
+func retryWhileEmpty(ctx context.Context) {
+	if config.EmptyRetryInterval <= 0 || discoveredServices() > 0 {
+		return
+	}
+	for discoveredServices() == 0 {
+		log.Warn().Msgf("No containers discovered yet, retrying in %s", config.EmptyRetryInterval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(config.EmptyRetryInterval):
+		}
+		refresh()
+	}
+	log.Info().Msgf("Discovered %d services after an empty start", discoveredServices())
+}
+
+// discoveredServices counts the services of the current snapshot discovered on any Docker host.
+func discoveredServices() int {
+	count := 0
+	for _, host := range dockerHosts() {
+		count += len(registry.Load().ServicesOf(host))
+	}
+	return count
+}
+
+// publish makes `next` the current snapshot and returns the previous one. The SOA
+// serial starts from the current time and is bumped whenever the records change.
+// Callers hold refreshMu, or run before any refresh can.
+func publish(next *Registry) *Registry {
+	next.serial = uint32(time.Now().Unix())
+	if previous := registry.Load(); previous != nil {
+		added, removed, changed := next.diff(previous)
+		next.serial = previous.serial
+		if len(added)+len(removed)+len(changed) > 0 {
+			next.serial++
+		}
+	}
+
+	servicesGauge.Set(float64(next.Len()))
+	previous := registry.Swap(next)
+	pruneRotations(next)
+	return previous
+}
+
+// newRegistry indexes discovered services by their fully-qualified names.
+func newRegistry(services []Service) *Registry {
+	r := &Registry{
+		services: make(map[string][]Service, len(services)),
+		srv:      make(map[string][]SRVRecord),
+		ptr:      make(map[string][]Service),
+	}
+
+	// Static hosts win over discovered services of the same name
+	static := make(map[string]bool)
+	for _, service := range services {
+		if service.Static {
+			static[dns.Fqdn(service.HostnameLabel)] = true
+		}
+	}
+
+	// Names given by labels win over Docker network aliases of the same name
+	labelled := make(map[string]bool)
+	for _, service := range services {
+		if !service.NetworkAlias {
+			labelled[dns.Fqdn(service.HostnameLabel)] = true
+		}
+	}
+
+	// Hostnames claimed by unrelated containers resolve unpredictably
+	dropped := make(map[string]bool)
+	for name, claims := range collisions(services) {
+		var owners []string
+		for _, claim := range claims {
+			owners = append(owners, fmt.Sprintf("`%s` (%s)", claim.ContainerName, claim.addressString()))
+		}
+		if config.Strict {
+			log.Warn().Msgf("Hostname `%s` is claimed by several containers: %s, dropping it", name, strings.Join(owners, ", "))
+			dropped[name] = true
+			continue
+		}
+		log.Warn().Msgf("Hostname `%s` is claimed by several containers: %s", name, strings.Join(owners, ", "))
+	}
+
+	for _, service := range services {
+		if dropped[service.HostnameLabel] {
+			continue
+		}
+		if !service.Static && static[dns.Fqdn(service.HostnameLabel)] {
+			log.Warn().Msgf("Hostname `%s` of `%s` is overridden by a static host", service.HostnameLabel, service.ContainerName)
+			continue
+		}
+		if service.NetworkAlias && labelled[dns.Fqdn(service.HostnameLabel)] {
+			log.Debug().Msgf("Network alias `%s` of `%s` is overridden by a labelled hostname", service.HostnameLabel, service.ContainerName)
+			continue
+		}
+
+		// Stopped containers keep their labels but lose their addresses
+		if !service.Static && service.IPAddress == nil && service.IPAddress6 == nil && service.CNAME == "" {
+			continue
+		}
+
+		// An alias can't share its name with any other record
+		name := dns.Fqdn(service.HostnameLabel)
+		if existing, ok := r.services[name]; ok && (existing[0].CNAME != "" || service.CNAME != "") {
+			log.Warn().Msgf("Hostname `%s` of `%s` conflicts with an alias registered by `%s`, skipping", service.HostnameLabel, service.ContainerName, existing[0].ContainerName)
+			continue
+		}
+
+		r.services[name] = append(r.services[name], service)
+		for _, record := range service.SRV {
+			record.TTL, record.ExpiresAt, record.LeaseEnd = service.RecordTTL, service.ExpiresAt, service.LeaseEnd
+
+			// Replicas sharing the hostname publish the same records
+			srvName := strings.ToLower(record.Service) + "." + name
+			if !slices.Contains(r.srv[srvName], record) {
+				r.srv[srvName] = append(r.srv[srvName], record)
+			}
+		}
+
+		// Index each address back to the hostname, once per hostname. Wildcards
+		// aren't names anything can be reversed to.
+		if strings.HasPrefix(name, "*.") {
+			continue
+		}
+		for _, ip := range []string{service.IPAddress.String(), service.IPAddress6.String()} {
+			reverse := reverseName(ip)
+			if reverse == "" {
+				continue
+			}
+			if !slices.ContainsFunc(r.ptr[reverse], func(s Service) bool { return s.HostnameLabel == service.HostnameLabel }) {
+				r.ptr[reverse] = append(r.ptr[reverse], service)
+			}
+		}
+	}
+
+	return r
+}
+
+// collisions finds the hostnames claimed by more than one container with different
+// addresses, returning every claim on each.
+func collisions(services []Service) map[string][]Service {
+	claims := make(map[string][]Service)
+	for _, service := range services {
+		if service.Static || service.CNAME != "" || (service.IPAddress == nil && service.IPAddress6 == nil) {
+			continue
+		}
+		claims[service.HostnameLabel] = append(claims[service.HostnameLabel], service)
+	}
+
+	conflicting := make(map[string][]Service)
+	for name, services := range claims {
+		for _, service := range services[1:] {
+			if service.ContainerName != services[0].ContainerName &&
+				(!service.IPAddress.Equal(services[0].IPAddress) || !service.IPAddress6.Equal(services[0].IPAddress6)) {
+				conflicting[name] = services
+				break
+			}
+		}
+	}
+	return conflicting
+}
+
+// Lookup returns the services registered for `name`, matched case-insensitively as
+// the keys are lowercase. Names without records of their own fall back to the most
+// specific wildcard above them, e.g. `*.apps.local.` for `foo.bar.apps.local.`.
+// An alias is always the only one.
+func (r *Registry) Lookup(name string) ([]Service, bool) {
+	name = strings.ToLower(name)
+	if services, ok := r.services[name]; ok {
+		return services, true
+	}
+
+	for {
+		dot := strings.IndexByte(name, '.')
+		if dot < 0 || dot == len(name)-1 {
+			return nil, false
+		}
+		name = name[dot+1:]
+		if services, ok := r.services["*."+name]; ok {
+			return services, true
+		}
+	}
+}
+
+// LookupSRV returns the SRV records registered for `name`.
+func (r *Registry) LookupSRV(name string) ([]SRVRecord, bool) {
+	records, ok := r.srv[strings.ToLower(name)]
+	return records, ok
+}
+
+// LookupPTR returns the services whose addresses have the reverse name `name`.
+func (r *Registry) LookupPTR(name string) ([]Service, bool) {
+	services, ok := r.ptr[strings.ToLower(name)]
+	return services, ok
+}
+
+// Exists reports whether any record is registered for `name`.
+func (r *Registry) Exists(name string) bool {
+	name = strings.ToLower(name)
+	_, service := r.Lookup(name)
+	_, srv := r.srv[name]
+	_, ptr := r.ptr[name]
+	return service || srv || ptr
+}
+
+// ServicesOf returns the services discovered on the Docker daemon at `host`.
+func (r *Registry) ServicesOf(host string) []Service {
+	if r == nil {
+		return nil
+	}
+	var services []Service
+	for _, name := range r.Names() {
+		for _, service := range r.services[name] {
+			if !service.Static && service.DockerHost == host {
+				services = append(services, service)
+			}
+		}
+	}
+	return services
+}
+
+// Serial returns the SOA serial of the snapshot.
+func (r *Registry) Serial() uint32 {
+	return r.serial
+}
+
+// Names returns the registered hostnames, sorted.
+func (r *Registry) Names() []string {
+	return slices.Sorted(maps.Keys(r.services))
+}
+
+// SRVNames returns the names holding SRV records, sorted.
+func (r *Registry) SRVNames() []string {
+	return slices.Sorted(maps.Keys(r.srv))
+}
+
+// Len returns the number of registered hostnames.
+func (r *Registry) Len() int {
+	return len(r.services)
+}
+
+// diff lists the hostnames added, removed and changed in `r` compared to `previous`,
+// each sorted.
+func (r *Registry) diff(previous *Registry) (added, removed, changed []string) {
+	for name, services := range r.services {
+		old, ok := previous.services[name]
+		switch {
+		case !ok:
+			added = append(added, name)
+		case !sameServices(services, old):
+			changed = append(changed, name)
+		}
+	}
+	for name := range previous.services {
+		if _, ok := r.services[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	slices.Sort(added)
+	slices.Sort(removed)
+	slices.Sort(changed)
+	return added, removed, changed
+}
+
+// sameServices reports whether two sets of services would produce the same answers,
+// whatever order discovery listed them in.
+func sameServices(a, b []Service) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	unmatched := slices.Clone(b)
+	for _, service := range a {
+		i := slices.IndexFunc(unmatched, func(other Service) bool { return sameRecords(service, other) })
+		if i < 0 {
+			return false
+		}
+		unmatched = slices.Delete(unmatched, i, i+1)
+	}
+	return true
+}
+
+// sameRecords reports whether two services would produce the same answers.
+func sameRecords(a, b Service) bool {
+	return a.IPAddress.Equal(b.IPAddress) &&
+		a.IPAddress6.Equal(b.IPAddress6) &&
+		a.CNAME == b.CNAME &&
+		a.RecordTTL == b.RecordTTL &&
+		a.Weight == b.Weight &&
+		slices.Equal(a.SRV, b.SRV) &&
+		slices.Equal(a.TXT, b.TXT) &&
+		slices.Equal(a.MX, b.MX) &&
+		slices.EqualFunc(a.Records, b.Records, dns.IsDuplicate)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/miekg/dns"
+)
+
+// TestRegistrySwap resolves while snapshots are published, so `go test -race` catches
+// any state shared between the resolver and a refresh.
+func TestRegistrySwap(t *testing.T) {
+	testConfig(t)
+	previous := registry.Load()
+	t.Cleanup(func() { registry.Store(previous) })
+	registry.Store(nil)
+
+	snapshot := func(i int) *Registry {
+		return newRegistry([]Service{{
+			ContainerName: "app",
+			HostnameLabel: "app.local",
+			IPAddress:     net.IPv4(10, 0, byte(i/256), byte(i%256)),
+			RecordTTL:     60,
+		}})
+	}
+	publish(snapshot(0))
+	res := newResolver(&registry)
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				// Not query, which may only fail the test from its own goroutine
+				r := new(dns.Msg)
+				r.SetQuestion("app.local.", dns.TypeA)
+				resp, _ := res.resolve(r, nil)
+				if len(resp.Answer) != 1 {
+					t.Errorf("got %d answers, want 1 from a whole snapshot", len(resp.Answer))
+					return
+				}
+			}
+		}()
+	}
+
+	serial := registry.Load().serial
+	for i := 1; i <= 200; i++ {
+		refreshMu.Lock()
+		publish(snapshot(i))
+		refreshMu.Unlock()
+	}
+	close(done)
+	wg.Wait()
+
+	if got, want := registry.Load().serial, serial+200; got != want {
+		t.Errorf("serial = %d, want %d after 200 changed snapshots", got, want)
+	}
+	if got := fmt.Sprint(registry.Load().services["app.local."][0].IPAddress); got != "10.0.0.200" {
+		t.Errorf("current address = %s, want the last published 10.0.0.200", got)
+	}
+}
+
+func TestRegistrySRVReplicas(t *testing.T) {
+	testConfig(t)
+	replica := func(name, hostname, ip, weight string) Service {
+		c := container.Summary{Names: []string{"/" + name}, Labels: map[string]string{
+			"com.autodns.srv":        "_http._tcp=80",
+			"com.autodns.srv.weight": weight,
+		}}
+		return Service{ContainerName: name, HostnameLabel: hostname, IPAddress: net.ParseIP(ip), SRV: srvTargeting(containerSRV(c), hostname)}
+	}
+
+	tests := []struct {
+		name     string
+		services []Service
+		query    string
+		want     []SRVRecord
+	}{
+		{
+			"replicas sharing a hostname",
+			[]Service{replica("app-1", "app.local", "10.0.0.1", "5"), replica("app-2", "app.local", "10.0.0.2", "5")},
+			"_http._tcp.app.local.",
+			[]SRVRecord{{Service: "_http._tcp", Port: 80, Weight: 5, Target: "app.local."}},
+		},
+		{
+			"replicas with different weights",
+			[]Service{replica("app-1", "app.local", "10.0.0.1", "3"), replica("app-2", "app.local", "10.0.0.2", "3"), replica("app-3", "app.local", "10.0.0.3", "1")},
+			"_http._tcp.app.local.",
+			[]SRVRecord{{Service: "_http._tcp", Port: 80, Weight: 3, Target: "app.local."}, {Service: "_http._tcp", Port: 80, Weight: 1, Target: "app.local."}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _ := newRegistry(tt.services).LookupSRV(tt.query)
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestRefreshFollowsLabels changes the labels of a running container between scans, as
+// `docker update` or a recreate under the same name would, and expects each refresh to
+// rebuild the registry from the current labels.
+func TestRefreshFollowsLabels(t *testing.T) {
+	testConfig(t)
+	testRegistry(t)
+	docker := newFakeDocker(t, testContainer("app", "172.18.0.5", map[string]string{"com.autodns.hostname": "old.local", "com.autodns.ttl": "60"}, "bridge"))
+
+	steps := []struct {
+		name    string
+		labels  map[string]string
+		ip      string
+		present string // The hostname expected, at `ip`
+		absent  string // A hostname expected gone
+		ttl     uint32
+	}{
+		{"initial scan", nil, "172.18.0.5", "old.local.", "", 60},
+		{"hostname changed", map[string]string{"com.autodns.hostname": "new.local", "com.autodns.ttl": "60"}, "172.18.0.5", "new.local.", "old.local.", 60},
+		{"TTL changed", map[string]string{"com.autodns.hostname": "new.local", "com.autodns.ttl": "300"}, "172.18.0.5", "new.local.", "", 300},
+		{"address changed", map[string]string{"com.autodns.hostname": "new.local", "com.autodns.ttl": "300"}, "172.18.0.9", "new.local.", "", 300},
+	}
+	for _, step := range steps {
+		if step.labels != nil {
+			docker.set(testContainer("app", step.ip, step.labels, "bridge"))
+		}
+		if err := tryRefresh(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+
+		snapshot := registry.Load()
+		services, ok := snapshot.Lookup(step.present)
+		if !ok || len(services) != 1 {
+			t.Fatalf("%s: %s not registered, got %v", step.name, step.present, snapshot.Names())
+		}
+		if got := services[0]; got.IPAddress.String() != step.ip || got.RecordTTL != step.ttl {
+			t.Errorf("%s: %s at %s with TTL %d, want %s and %d", step.name, step.present, got.IPAddress, got.RecordTTL, step.ip, step.ttl)
+		}
+		if _, ok := snapshot.Lookup(step.absent); step.absent != "" && ok {
+			t.Errorf("%s: %s still registered", step.name, step.absent)
+		}
+	}
+}
+
+func TestReverseName(t *testing.T) {
+	tests := []struct {
+		ip      string
+		want    string
+		reverse bool // Whether `want` is recognised as a reverse name
+	}{
+		{"10.0.0.1", "1.0.0.10.in-addr.arpa.", true},
+		{"192.168.1.20", "20.1.168.192.in-addr.arpa.", true},
+		{"fd00::1", "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.", true},
+		{"not-an-ip", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := reverseName(tt.ip); got != tt.want {
+				t.Fatalf("reverseName(%q) = %q, want %q", tt.ip, got, tt.want)
+			}
+			if got := isReverseName(tt.want); got != tt.reverse {
+				t.Errorf("isReverseName(%q) = %v, want %v", tt.want, got, tt.reverse)
+			}
+		})
+	}
+
+	for name, want := range map[string]bool{
+		"1.0.0.10.IN-ADDR.ARPA.": true,
+		"in-addr.arpa.":          false,
+		"app.local.":             false,
+		"arpa.app.local.":        false,
+	} {
+		if got := isReverseName(name); got != want {
+			t.Errorf("isReverseName(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestRegistryLookupPTR(t *testing.T) {
+	testConfig(t)
+	snapshot := newRegistry([]Service{
+		{ContainerName: "app", HostnameLabel: "app.local", IPAddress: net.ParseIP("10.0.0.1"), IPAddress6: net.ParseIP("fd00::1"), RecordTTL: 60},
+		{ContainerName: "alias", HostnameLabel: "alias.local", CNAME: "app.local.", RecordTTL: 60},
+	})
+
+	tests := []struct {
+		name string
+		want []string // Hostnames the name points back to
+	}{
+		{"1.0.0.10.in-addr.arpa.", []string{"app.local"}},
+		{"1.0.0.10.In-Addr.Arpa.", []string{"app.local"}},
+		{reverseName("fd00::1"), []string{"app.local"}},
+		{"2.0.0.10.in-addr.arpa.", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			services, ok := snapshot.LookupPTR(tt.name)
+			var got []string
+			for _, service := range services {
+				got = append(got, service.HostnameLabel)
+			}
+			if ok != (tt.want != nil) || !slices.Equal(got, tt.want) {
+				t.Errorf("LookupPTR(%q) = %q, %v, want %q", tt.name, got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegistryLookupWildcard(t *testing.T) {
+	testConfig(t)
+	snapshot := newRegistry([]Service{
+		{ContainerName: "proxy", HostnameLabel: "*.apps.local", IPAddress: net.ParseIP("10.0.0.1"), RecordTTL: 60},
+		{ContainerName: "exact", HostnameLabel: "exact.apps.local", IPAddress: net.ParseIP("10.0.0.2"), RecordTTL: 60},
+		{ContainerName: "deep", HostnameLabel: "*.deep.apps.local", IPAddress: net.ParseIP("10.0.0.3"), RecordTTL: 60},
+	})
+
+	tests := []struct {
+		name string
+		want string // The container answering, "" for none
+	}{
+		{"foo.apps.local.", "proxy"},
+		{"foo.bar.apps.local.", "proxy"},
+		{"exact.apps.local.", "exact"},
+		{"EXACT.Apps.Local.", "exact"},
+		{"sub.exact.apps.local.", "proxy"},
+		{"deep.apps.local.", "proxy"},
+		{"x.deep.apps.local.", "deep"},
+		{"x.y.deep.apps.local.", "deep"},
+		{"apps.local.", ""},
+		{"other.local.", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			services, ok := snapshot.Lookup(tt.name)
+			var got string
+			if ok {
+				got = services[0].ContainerName
+			}
+			if got != tt.want {
+				t.Errorf("Lookup(%q) answered by %q, want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+// Resolver answers DNS queries from the published registry snapshots.
+type Resolver struct {
+	registry *atomic.Pointer[Registry]
+	allow    *allowList   // nil without `AUTODNS_ALLOW_CIDRS`
+	limiter  *rateLimiter // nil without `AUTODNS_RATE_LIMIT`
+}
+
+func newResolver(registry *atomic.Pointer[Registry]) *Resolver {
+	res := &Resolver{registry: registry}
+	if len(config.AllowCIDRs) > 0 {
+		res.allow, _ = newAllowList(config.AllowCIDRs) // Validated by loadConfig
+	}
+	if config.RateLimit > 0 {
+		res.limiter = newRateLimiter(config.RateLimit)
+	}
+	return res
+}
+
+// newDNSMux routes every name to `res`.
+func newDNSMux(res *Resolver) *dns.ServeMux {
+	mux := dns.NewServeMux()
+	mux.Handle(".", res)
+	return mux
+}
+
+// maxQuestions caps the questions a single query may ask.
+const maxQuestions = 16
+
+// acceptQuery is dns.DefaultMsgAcceptFunc, except that it lets queries ask up to
+// maxQuestions questions instead of exactly one.
+func acceptQuery(dh dns.Header) dns.MsgAcceptAction {
+	if dh.Qdcount > 1 && dh.Qdcount <= maxQuestions {
+		dh.Qdcount = 1
+	}
+	return dns.DefaultMsgAcceptFunc(dh)
+}
+
+// ServeDNS answers `r`, forwarding it upstream when the name is ours to forward.
+func (res *Resolver) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	if len(r.Question) == 0 {
+		log.Warn().Msg("Received DNS query with no questions")
+		return
+	}
+	q := r.Question[0]
+	start := time.Now()
+
+	// Count the query, and the response code of whatever gets written back
+	queriesTotal.WithLabelValues(dns.TypeToString[q.Qtype]).Inc()
+	metrics := &metricsWriter{ResponseWriter: w, rcode: -1}
+
+	// Tell UDP clients to retry over TCP when the answer doesn't fit their buffer
+	w = newTruncatingWriter(metrics, r)
+
+	// Answer EDNS0 queries with an OPT record of our own
+	w = newEDNSWriter(w, r)
+
+	// Per-query detail for debugging misbehaving clients
+	defer func() {
+		log.Debug().
+			Str("client", w.RemoteAddr().String()).
+			Str("name", q.Name).
+			Str("qtype", dns.TypeToString[q.Qtype]).
+			Str("rcode", dns.RcodeToString[metrics.rcode]).
+			Dur("latency", time.Since(start)).
+			Msg("DNS query")
+	}()
+
+	// Refuse clients outside the trusted subnets
+	if res.allow != nil && !res.allow.Allow(w.RemoteAddr()) {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeRefused)
+		w.WriteMsg(m)
+		return
+	}
+
+	// Refuse clients flooding the server
+	if res.limiter != nil && !res.limiter.Allow(w.RemoteAddr()) {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeRefused)
+		w.WriteMsg(m)
+		return
+	}
+
+	// Zone transfers stream many messages rather than one answer
+	if q.Qtype == dns.TypeAXFR {
+		serveAXFR(w, r, res.registry.Load())
+		return
+	}
+
+	// Some tools ask several questions at once, which upstreams rarely support
+	if len(r.Question) > maxQuestions {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeFormatError)
+		w.WriteMsg(m)
+		return
+	}
+	if len(r.Question) > 1 {
+		if err := w.WriteMsg(res.resolveAll(r, clientIP(w.RemoteAddr()))); err != nil {
+			log.Error().Err(err).Msgf("Failed to write DNS response for %d questions", len(r.Question))
+		}
+		return
+	}
+
+	resp, forward := res.resolve(r, clientIP(w.RemoteAddr()))
+	if forward {
+		forwardQuery(w, r)
+		return
+	}
+	if err := w.WriteMsg(resp); err != nil {
+		log.Error().Err(err).Msgf("Failed to write DNS response for %s", q.Name)
+	}
+}
+
+// resolveAll answers every question of `r` in one response. Questions that fail, or
+// would be forwarded upstream, are kept without an answer; the response code is that
+// of the first question unless another one was answered.
+func (res *Resolver) resolveAll(r *dns.Msg, client net.IP) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(r)
+	resp.Question = r.Question
+	resp.Authoritative = true
+
+	answered := false
+	for i, q := range r.Question {
+		single := r.Copy()
+		single.Question = []dns.Question{q}
+		part, forward := res.resolve(single, client)
+		if forward {
+			log.Debug().Msgf("Not forwarding %s, asked among %d questions", q.Name, len(r.Question))
+			part = new(dns.Msg)
+			part.SetRcode(single, dns.RcodeServerFailure)
+		}
+
+		if i == 0 {
+			resp.Rcode = part.Rcode
+			resp.RecursionAvailable = part.RecursionAvailable
+		}
+		if len(part.Answer) > 0 {
+			answered = true
+		}
+		resp.Authoritative = resp.Authoritative && part.Authoritative
+		resp.Answer = appendUnique(resp.Answer, part.Answer...)
+		resp.Ns = appendUnique(resp.Ns, part.Ns...)
+		resp.Extra = appendUnique(resp.Extra, part.Extra...)
+	}
+	if answered {
+		resp.Rcode = dns.RcodeSuccess
+	}
+	return resp
+}
+
+// clientIP returns the IP address of the client at `addr`, or nil for Unix socket clients.
+func clientIP(addr net.Addr) net.IP {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// appendUnique appends the records of `rrs` not already in `records`.
+func appendUnique(records []dns.RR, rrs ...dns.RR) []dns.RR {
+	for _, rr := range rrs {
+		if !slices.ContainsFunc(records, func(record dns.RR) bool { return dns.IsDuplicate(record, rr) }) {
+			records = append(records, rr)
+		}
+	}
+	return records
+}
+
+// Resolve returns the records answering `q`, or none if the name is unknown.
+func (res *Resolver) Resolve(q dns.Question) []dns.RR {
+	r := new(dns.Msg)
+	r.Question = []dns.Question{q}
+
+	resp, forward := res.resolve(r, nil)
+	if forward {
+		return nil
+	}
+	return resp.Answer
+}
+
+// resolve builds the response to the first question of `r` asked by `client`, nil if
+// unknown, or reports that it should be forwarded to the upstream resolver instead.
+func (res *Resolver) resolve(r *dns.Msg, client net.IP) (*dns.Msg, bool) {
+	q := r.Question[0]
+	name := dns.Fqdn(q.Name)
+
+	// Use a single snapshot for the whole query
+	snapshot := res.registry.Load()
+
+	// Built-in status probe, answered in any class
+	if config.StatusName != "" && q.Qtype == dns.TypeTXT && strings.EqualFold(name, config.StatusName) {
+		resp := makeStatusResponse(q, snapshot.Len())
+		resp.SetReply(r)
+		log.Info().Msgf("DNS status response for %s", name)
+		return resp, false
+	}
+
+	// Conventional version probe of the CHAOS class
+	if q.Qclass == dns.ClassCHAOS && q.Qtype == dns.TypeTXT && strings.EqualFold(name, "version.bind.") {
+		resp := makeVersionResponse(q)
+		resp.SetReply(r)
+		log.Info().Msgf("DNS version response for %s", name)
+		return resp, false
+	}
+
+	// And its server identity probes, for monitoring tools
+	if q.Qclass == dns.ClassCHAOS && q.Qtype == dns.TypeTXT && (strings.EqualFold(name, "id.server.") || strings.EqualFold(name, "hostname.bind.")) {
+		resp := makeIdentityResponse(q)
+		resp.SetReply(r)
+		log.Info().Msgf("DNS identity response for %s", name)
+		return resp, false
+	}
+
+	// All other records are in the Internet class
+	if q.Qclass != dns.ClassINET && q.Qclass != dns.ClassANY {
+		log.Debug().Msgf("Refusing %s query for %s", dns.ClassToString[q.Qclass], name)
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeRefused)
+		return m, false
+	}
+
+	// Where a hostname's records come from, for debugging
+	if target, ok := debugTarget(name); ok && config.DebugRecords && q.Qtype == dns.TypeTXT {
+		if services, ok := snapshot.Lookup(target); ok {
+			resp := makeDebugResponse(name, services)
+			resp.SetReply(r)
+			log.Info().Msgf("DNS debug response for %s: %d services", name, len(services))
+			return resp, false
+		}
+	}
+
+	// The managed domain's own SOA record
+	if q.Qtype == dns.TypeSOA && config.Domain != "" && strings.EqualFold(name, zoneName()) {
+		resp := makeSOAResponse(snapshot.Serial())
+		resp.SetReply(r)
+		log.Info().Msgf("DNS SOA response for %s: serial %d", name, snapshot.Serial())
+		return resp, false
+	}
+
+	// The name server the managed domain is delegated to
+	if q.Qtype == dns.TypeNS && config.Domain != "" && strings.EqualFold(name, zoneName()) {
+		resp := makeNSResponse(snapshot)
+		resp.SetReply(r)
+		log.Info().Msgf("DNS NS response for %s: %s", name, config.NSName)
+		return resp, false
+	}
+
+	// During maintenance every in-zone name points at the status page
+	if ip := maintenance(); ip != nil && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA) && ownsName(name, snapshot) {
+		var ips []net.IP // The other address family gets an empty answer
+		if (ip.To4() != nil) == (q.Qtype == dns.TypeA) {
+			ips = []net.IP{ip}
+		}
+		resp := makeResponse(name, ips, maintenanceTTL, true)
+		resp.SetReply(r)
+		log.Info().Msgf("DNS maintenance response for %s: %s", name, ip)
+		return resp, false
+	}
+
+	// Best effort, known addresses are reversed outside the declared reverse zones too.
+	// Nothing delegates those names to us, so the answer isn't authoritative.
+	if config.PTRBestEffort && q.Qtype == dns.TypePTR && !ownsName(name, snapshot) {
+		if services, ok := snapshot.LookupPTR(name); ok && anyLive(services, time.Now()) {
+			resp := makePTRResponse(name, services, time.Now())
+			resp.SetReply(r)
+			resp.Authoritative = false
+			log.Info().Msgf("DNS PTR response for %s outside the owned zones: %d records", name, len(resp.Answer))
+			return resp, false
+		}
+	}
+
+	// Names outside our zones are someone else's to answer
+	if !ownsName(name, snapshot) {
+		if len(config.Upstream) > 0 {
+			return nil, true
+		}
+		log.Debug().Msgf("Refusing query for %s outside the owned zones", name)
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeRefused)
+		return m, false
+	}
+
+	// Aliases answer with their CNAME whatever the type, as they can't hold other data
+	if services, ok := snapshot.Lookup(name); ok && services[0].CNAME != "" && !services[0].Expired(time.Now()) {
+		alias := services[0]
+		resp := makeCNAMEResponse(name, alias.CNAME, alias.TTL(time.Now()), q.Qtype, snapshot)
+		resp.SetReply(r)
+		if q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA {
+			resp.Extra = glue(snapshot, alias.CNAME, time.Now())
+		}
+		log.Info().Msgf("DNS CNAME response for %s: %s", name, alias.CNAME)
+		return resp, false
+	}
+
+	if q.Qtype == dns.TypeSRV {
+		now := time.Now()
+		records, ok := snapshot.LookupSRV(name)
+		resp := makeSRVResponse(name, records, now)
+		if !ok || len(resp.Answer) == 0 {
+			log.Warn().Msgf("No SRV records found for: %s", name)
+			return makeNegativeResponse(r, snapshot, name), false
+		}
+		resp.SetReply(r)
+
+		// Spare the client a lookup of each target we hold
+		seen := make(map[string]bool)
+		for _, record := range records {
+			if target := strings.ToLower(record.Target); !seen[target] {
+				seen[target] = true
+				resp.Extra = append(resp.Extra, glue(snapshot, record.Target, now)...)
+			}
+		}
+		log.Info().Msgf("DNS SRV response for %s: %d records", name, len(records))
+		return resp, false
+	}
+
+	// Reverse lookups of discovered addresses
+	if q.Qtype == dns.TypePTR && isReverseName(name) {
+		now := time.Now()
+		services, ok := snapshot.LookupPTR(name)
+		if !ok || !anyLive(services, now) {
+			log.Warn().Msgf("No PTR records found for: %s", name)
+			return makeNegativeResponse(r, snapshot, name), false
+		}
+		resp := makePTRResponse(name, services, now)
+		resp.SetReply(r)
+		log.Info().Msgf("DNS PTR response for %s: %d records", name, len(resp.Answer))
+		return resp, false
+	}
+
+	// Names in the dynamic zone carry their own address and never hit the service map
+	if dynamicIP, inZone := resolveDynamic(name); inZone {
+		if dynamicIP == nil {
+			log.Warn().Msgf("Name %s does not encode a valid address in the dynamic zone", name)
+			m := new(dns.Msg)
+			m.SetRcode(r, dns.RcodeNameError)
+			return addSOA(m, name, snapshot), false
+		}
+		resp := makeResponse(name, []net.IP{dynamicIP}, config.TTL, true)
+		resp.SetReply(r)
+		log.Info().Msgf("DNS response for %s: %s (dynamic)", name, dynamicIP)
+		return resp, false
+	}
+
+	services, ok := snapshot.Lookup(name)
+	if !ok {
+		log.Warn().Msgf("No service found for hostname: %s", name)
+		return makeNegativeResponse(r, snapshot, name), false
+	}
+
+	// Expired services no longer exist
+	now := time.Now()
+	if !anyLive(services, now) {
+		log.Info().Msgf("All services for hostname %s have expired", name)
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeNameError)
+		m.Authoritative = true
+		return addSOA(m, name, snapshot), false
+	}
+
+	if q.Qtype == dns.TypeANY {
+		resp := makeANYResponse(name, services, snapshot, now, addressTypes(services, now))
+		if config.Domain != "" && strings.EqualFold(name, zoneName()) {
+			// A container at the apex shares it with the zone's own records
+			resp.Answer = append(resp.Answer, makeSOAResponse(snapshot.Serial()).Answer...)
+			resp.Answer = append(resp.Answer, makeNSResponse(snapshot).Answer...)
+		}
+		resp.SetReply(r)
+		log.Info().Msgf("DNS ANY response for %s: %d records", name, len(resp.Answer))
+		return resp, false
+	}
+
+	if q.Qtype == dns.TypeMX {
+		resp := makeMXResponse(name, services, now)
+		resp.Answer = append(resp.Answer, rawRecords(name, services, q.Qtype, now)...)
+		if len(resp.Answer) == 0 {
+			log.Debug().Msgf("Services for hostname %s have no MX record", name)
+			m := new(dns.Msg)
+			m.SetReply(r)
+			return addSOA(m, name, snapshot), false // Empty NOERROR response
+		}
+		resp.SetReply(r)
+		log.Info().Msgf("DNS MX response for %s: %d records", name, len(resp.Answer))
+		return resp, false
+	}
+
+	if q.Qtype == dns.TypeTXT {
+		resp := makeTXTResponse(name, services, now)
+		resp.Answer = append(resp.Answer, rawRecords(name, services, q.Qtype, now)...)
+		if len(resp.Answer) == 0 {
+			log.Debug().Msgf("Services for hostname %s have no TXT record", name)
+			m := new(dns.Msg)
+			m.SetReply(r)
+			return addSOA(m, name, snapshot), false // Empty NOERROR response
+		}
+		resp.SetReply(r)
+		log.Info().Msgf("DNS TXT response for %s: %d records", name, len(resp.Answer))
+		return resp, false
+	}
+
+	// The name exists, but may lack an address of the requested family. Other types
+	// only come verbatim from `com.autodns.record`.
+	var ips []net.IP
+	var ttl uint32
+	if q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA {
+		ips, ttl = addresses(services, q.Qtype, now, subnetClient(r, client))
+	}
+	raw := rawRecords(name, services, q.Qtype, now)
+	if len(ips) == 0 && len(raw) == 0 {
+		log.Debug().Msgf("Services for hostname %s have no %s record", name, dns.TypeToString[q.Qtype])
+		m := new(dns.Msg)
+		m.SetReply(r)
+		return addSOA(m, name, snapshot), false // Empty NOERROR response
+	}
+
+	ips = capAnswers(ips)
+	// Only answers to clients are jittered, zone transfers and dry runs stay reproducible
+	resp := makeResponse(name, ips, jitterTTL(ttl, lifetime(services, now)), ownsName(name, snapshot))
+	resp.Answer = append(resp.Answer, raw...)
+	if config.PrefetchHints {
+		resp.Extra = append(resp.Extra, prefetchHints(name, services, q.Qtype, now)...)
+	}
+	resp.SetReply(r)
+	log.Info().Msgf("DNS response for %s: %v", name, ips)
+	return resp, false
+}
+
+// prefetchHints returns the records of `name` of the types among A, AAAA and HTTPS
+// other than `qtype`, for the additional section, or none if `qtype` isn't one of them.
+// Address families left out by `AUTODNS_PREFER` aren't hinted at.
+func prefetchHints(name string, services []Service, qtype uint16, now time.Time) []dns.RR {
+	if qtype != dns.TypeA && qtype != dns.TypeAAAA && qtype != dns.TypeHTTPS {
+		return nil
+	}
+
+	var records []dns.RR
+	for _, hinted := range addressTypes(services, now) {
+		if hinted == qtype {
+			continue
+		}
+		if ips, ttl := addresses(services, hinted, now, nil); len(ips) > 0 {
+			records = append(records, makeResponse(name, capAnswers(ips), ttl, true).Answer...)
+		}
+	}
+	if qtype != dns.TypeHTTPS {
+		records = append(records, rawRecords(name, services, dns.TypeHTTPS, now)...)
+	}
+	return records
+}
+
+// glue returns the address records of `target` for the additional section, when it is
+// one of our own names holding addresses rather than an alias.
+func glue(snapshot *Registry, target string, now time.Time) []dns.RR {
+	services, ok := snapshot.Lookup(target)
+	if !ok || services[0].CNAME != "" {
+		return nil
+	}
+
+	var records []dns.RR
+	for _, qtype := range addressTypes(services, now) {
+		if ips, ttl := addresses(services, qtype, now, nil); len(ips) > 0 {
+			records = append(records, makeResponse(target, capAnswers(ips), ttl, true).Answer...)
+		}
+	}
+	return records
+}
+
+// makeANYResponse gathers every record held for `name`: its addresses of the types in
+// `qtypes`, TXT values, mail exchangers, verbatim records and any SRV records registered
+// at the name itself.
+func makeANYResponse(name string, services []Service, snapshot *Registry, now time.Time, qtypes []uint16) *dns.Msg {
+	var records []dns.RR
+	for _, qtype := range qtypes {
+		if ips, ttl := addresses(services, qtype, now, nil); len(ips) > 0 {
+			records = append(records, makeResponse(name, ips, ttl, true).Answer...)
+		}
+	}
+	records = append(records, makeTXTResponse(name, services, now).Answer...)
+	records = append(records, makeMXResponse(name, services, now).Answer...)
+	records = append(records, rawRecords(name, services, dns.TypeANY, now)...)
+	if srv, ok := snapshot.LookupSRV(name); ok {
+		records = append(records, makeSRVResponse(name, srv, now).Answer...)
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(&dns.Msg{})
+	m.Authoritative = true
+	m.RecursionAvailable = true
+	m.Answer = records
+
+	return m
+}
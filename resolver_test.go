@@ -0,0 +1,650 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// testConfig resets the global configuration to its defaults for a test, restoring
+// the previous one afterwards.
+func testConfig(t testing.TB) {
+	t.Helper()
+	previous := config
+	config = defaultConfig()
+	config.Order = "stable"
+	t.Cleanup(func() { config = previous })
+}
+
+// newTestResolver returns a resolver answering from a registry of `services`.
+func newTestResolver(t testing.TB, services ...Service) *Resolver {
+	t.Helper()
+	var snapshot atomic.Pointer[Registry]
+	snapshot.Store(newRegistry(services))
+	return newResolver(&snapshot)
+}
+
+// query resolves a single question against `res`, failing if it would be forwarded.
+func query(t *testing.T, res *Resolver, name string, qtype, qclass uint16) *dns.Msg {
+	t.Helper()
+	r := new(dns.Msg)
+	r.SetQuestion(name, qtype)
+	r.Question[0].Qclass = qclass
+	resp, forward := res.resolve(r, nil)
+	if forward {
+		t.Fatalf("query for %s was forwarded", name)
+	}
+	return resp
+}
+
+func TestResolveRefusesOtherClasses(t *testing.T) {
+	testConfig(t)
+	res := newTestResolver(t,
+		Service{ContainerName: "app", HostnameLabel: "app.local", IPAddress: net.ParseIP("10.0.0.1"), RecordTTL: 60},
+		Service{ContainerName: "alias", HostnameLabel: "alias.local", CNAME: "app.local.", RecordTTL: 60},
+	)
+
+	tests := []struct {
+		name   string
+		qname  string
+		qtype  uint16
+		qclass uint16
+		rcode  int
+	}{
+		{"address in IN", "app.local.", dns.TypeA, dns.ClassINET, dns.RcodeSuccess},
+		{"address in ANY", "app.local.", dns.TypeA, dns.ClassANY, dns.RcodeSuccess},
+		{"address in CH", "app.local.", dns.TypeA, dns.ClassCHAOS, dns.RcodeRefused},
+		{"address in HS", "app.local.", dns.TypeA, dns.ClassHESIOD, dns.RcodeRefused},
+		{"alias in IN", "alias.local.", dns.TypeA, dns.ClassINET, dns.RcodeSuccess},
+		{"alias in CH", "alias.local.", dns.TypeA, dns.ClassCHAOS, dns.RcodeRefused},
+		{"alias TXT in CH", "alias.local.", dns.TypeTXT, dns.ClassCHAOS, dns.RcodeRefused},
+		{"version.bind in CH", "version.bind.", dns.TypeTXT, dns.ClassCHAOS, dns.RcodeSuccess},
+		{"id.server in CH", "id.server.", dns.TypeTXT, dns.ClassCHAOS, dns.RcodeSuccess},
+		{"version.bind in IN", "version.bind.", dns.TypeTXT, dns.ClassINET, dns.RcodeRefused},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := query(t, res, tt.qname, tt.qtype, tt.qclass)
+			if resp.Rcode != tt.rcode {
+				t.Fatalf("rcode = %s, want %s", dns.RcodeToString[resp.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			for _, rr := range append(resp.Answer, resp.Extra...) {
+				if want := tt.qclass; want != dns.ClassANY && rr.Header().Class != want {
+					t.Errorf("record %s has class %s, want %s", rr, dns.ClassToString[rr.Header().Class], dns.ClassToString[want])
+				}
+			}
+		})
+	}
+}
+
+func TestResolveSRVTTL(t *testing.T) {
+	testConfig(t)
+	now := time.Now()
+	srv := func(hostname string) []SRVRecord {
+		return []SRVRecord{{Service: "_http._tcp", Port: 80, Target: hostname + "."}}
+	}
+	res := newTestResolver(t,
+		Service{ContainerName: "short", HostnameLabel: "short.local", IPAddress: net.ParseIP("10.0.0.1"), RecordTTL: 60, SRV: srv("short.local")},
+		Service{ContainerName: "expiring", HostnameLabel: "expiring.local", IPAddress: net.ParseIP("10.0.0.2"), RecordTTL: 3600, ExpiresAt: now.Add(30 * time.Second), SRV: srv("expiring.local")},
+		Service{ContainerName: "expired", HostnameLabel: "expired.local", IPAddress: net.ParseIP("10.0.0.3"), RecordTTL: 3600, ExpiresAt: now.Add(-time.Second), SRV: srv("expired.local")},
+	)
+
+	tests := []struct {
+		name   string
+		qname  string
+		minTTL uint32
+		maxTTL uint32
+		empty  bool // Whether the answer is empty, as for expired services
+	}{
+		{"service TTL", "_http._tcp.short.local.", 60, 60, false},
+		{"capped by expiry", "_http._tcp.expiring.local.", 1, 30, false},
+		{"expired", "_http._tcp.expired.local.", 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := query(t, res, tt.qname, dns.TypeSRV, dns.ClassINET)
+			if resp.Rcode != dns.RcodeSuccess {
+				t.Fatalf("rcode = %s, want NOERROR", dns.RcodeToString[resp.Rcode])
+			}
+			if tt.empty {
+				if len(resp.Answer) != 0 {
+					t.Fatalf("got %d answers for an expired service", len(resp.Answer))
+				}
+				return
+			}
+			if len(resp.Answer) != 1 {
+				t.Fatalf("got %d answers, want 1", len(resp.Answer))
+			}
+			if ttl := resp.Answer[0].Header().Ttl; ttl < tt.minTTL || ttl > tt.maxTTL {
+				t.Errorf("TTL = %d, want %d to %d", ttl, tt.minTTL, tt.maxTTL)
+			}
+		})
+	}
+}
+
+func TestResolveRotateInterleaved(t *testing.T) {
+	testConfig(t)
+	config.Order = "rotate"
+	rotations.Clear()
+	res := newTestResolver(t,
+		Service{ContainerName: "app-1", HostnameLabel: "app.local", IPAddress: net.ParseIP("10.0.0.1"), IPAddress6: net.ParseIP("fd00::1"), RecordTTL: 60},
+		Service{ContainerName: "app-2", HostnameLabel: "app.local", IPAddress: net.ParseIP("10.0.0.2"), IPAddress6: net.ParseIP("fd00::2"), RecordTTL: 60},
+		Service{ContainerName: "alias", HostnameLabel: "alias.local", CNAME: "app.local.", RecordTTL: 60},
+	)
+
+	// Clients asking for both families at once, with ANY and alias queries in between
+	leaders := map[uint16][]string{}
+	for range 4 {
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeANY} {
+			for _, name := range []string{"app.local.", "alias.local."} {
+				r := new(dns.Msg)
+				r.SetQuestion(name, qtype)
+				resp, _ := res.resolve(r, net.ParseIP("192.0.2.1"))
+				if name == "app.local." && qtype != dns.TypeANY {
+					leaders[qtype] = append(leaders[qtype], resp.Answer[0].String())
+				}
+			}
+		}
+	}
+
+	for qtype, answers := range leaders {
+		for i := range answers {
+			if (answers[i] == answers[(i+1)%len(answers)]) || answers[i] != answers[(i+2)%len(answers)] {
+				t.Fatalf("%s answers led by %v, want the backends to take turns", dns.TypeToString[qtype], answers)
+			}
+		}
+	}
+}
+
+func TestResolvePrefetchHints(t *testing.T) {
+	https, err := dns.NewRR(". 60 IN HTTPS 1 . alpn=h2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	services := []Service{
+		{ContainerName: "app", HostnameLabel: "app.local", IPAddress: net.ParseIP("10.0.0.1"), IPAddress6: net.ParseIP("fd00::1"), Records: []dns.RR{https}, RecordTTL: 60},
+		{ContainerName: "v4", HostnameLabel: "v4.local", IPAddress: net.ParseIP("10.0.0.2"), RecordTTL: 60},
+	}
+
+	tests := []struct {
+		name    string
+		enabled bool
+		prefer  string
+		qname   string
+		qtype   uint16
+		hints   []uint16 // The types expected in the additional section
+	}{
+		{"disabled", false, "both", "app.local.", dns.TypeA, nil},
+		{"A", true, "both", "app.local.", dns.TypeA, []uint16{dns.TypeAAAA, dns.TypeHTTPS}},
+		{"AAAA", true, "both", "app.local.", dns.TypeAAAA, []uint16{dns.TypeA, dns.TypeHTTPS}},
+		{"HTTPS", true, "both", "app.local.", dns.TypeHTTPS, []uint16{dns.TypeA, dns.TypeAAAA}},
+		{"HTTPS disabled", false, "both", "app.local.", dns.TypeHTTPS, nil},
+		{"other types", true, "both", "app.local.", dns.TypeTXT, nil},
+		{"preferred family only", true, "v4", "app.local.", dns.TypeHTTPS, []uint16{dns.TypeA}},
+		{"nothing to hint", true, "both", "v4.local.", dns.TypeA, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testConfig(t)
+			config.PrefetchHints, config.Prefer = tt.enabled, tt.prefer
+			resp := query(t, newTestResolver(t, services...), tt.qname, tt.qtype, dns.ClassINET)
+
+			// The answer section only ever holds the queried type
+			for _, rr := range resp.Answer {
+				if rr.Header().Rrtype != tt.qtype {
+					t.Errorf("answer section holds %s", rr)
+				}
+			}
+			var hints []uint16
+			for _, rr := range resp.Extra {
+				if rr.Header().Name != tt.qname {
+					t.Errorf("hint %s is for another name", rr)
+				}
+				hints = append(hints, rr.Header().Rrtype)
+			}
+			if !slices.Equal(hints, tt.hints) {
+				t.Fatalf("additional types = %v, want %v", hints, tt.hints)
+			}
+		})
+	}
+}
+
+func TestResolvePTRBestEffort(t *testing.T) {
+	services := []Service{
+		{ContainerName: "app", HostnameLabel: "app.local", IPAddress: net.ParseIP("10.0.0.1"), RecordTTL: 60},
+		{ContainerName: "db", HostnameLabel: "db.local", IPAddress: net.ParseIP("192.168.1.5"), RecordTTL: 60},
+	}
+
+	tests := []struct {
+		name          string
+		bestEffort    bool
+		qname         string
+		rcode         int
+		authoritative bool
+		target        string // The PTR target, "" for none
+	}{
+		{"in a reverse zone, strict", false, "1.0.0.10.in-addr.arpa.", dns.RcodeSuccess, true, "app.local."},
+		{"in a reverse zone, best effort", true, "1.0.0.10.in-addr.arpa.", dns.RcodeSuccess, true, "app.local."},
+		{"outside the reverse zones, strict", false, "5.1.168.192.in-addr.arpa.", dns.RcodeRefused, false, ""},
+		{"outside the reverse zones, best effort", true, "5.1.168.192.in-addr.arpa.", dns.RcodeSuccess, false, "db.local."},
+		{"unknown address, best effort", true, "9.1.168.192.in-addr.arpa.", dns.RcodeRefused, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testConfig(t)
+			config.Zones = []string{"local.", "10.in-addr.arpa."}
+			config.PTRBestEffort = tt.bestEffort
+
+			resp := query(t, newTestResolver(t, services...), tt.qname, dns.TypePTR, dns.ClassINET)
+			if resp.Rcode != tt.rcode {
+				t.Fatalf("rcode = %s, want %s", dns.RcodeToString[resp.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			if resp.Authoritative != tt.authoritative {
+				t.Errorf("AA = %v, want %v", resp.Authoritative, tt.authoritative)
+			}
+			var target string
+			if len(resp.Answer) == 1 {
+				target = resp.Answer[0].(*dns.PTR).Ptr
+			}
+			if target != tt.target {
+				t.Errorf("PTR target = %q, want %q", target, tt.target)
+			}
+		})
+	}
+}
+
+func TestResolveApexHostname(t *testing.T) {
+	testConfig(t)
+	config.Domain = "example.test"
+	config.NSName, config.SOAMname, config.SOARname = "ns.example.test.", "ns.example.test.", "hostmaster.example.test."
+	res := newTestResolver(t, Service{ContainerName: "site", HostnameLabel: "example.test", IPAddress: net.ParseIP("10.0.0.1"), RecordTTL: 60})
+
+	tests := []struct {
+		qtype   uint16
+		answers []uint16 // The types in the answer section
+		soa     bool     // Whether the authority section holds the SOA, as for empty answers
+	}{
+		{dns.TypeA, []uint16{dns.TypeA}, false},
+		{dns.TypeSOA, []uint16{dns.TypeSOA}, false},
+		{dns.TypeNS, []uint16{dns.TypeNS}, false},
+		{dns.TypeAAAA, nil, true},
+		{dns.TypeMX, nil, true},
+		{dns.TypeTXT, nil, true},
+		{dns.TypeANY, []uint16{dns.TypeA, dns.TypeSOA, dns.TypeNS}, false},
+	}
+	for _, tt := range tests {
+		t.Run(dns.TypeToString[tt.qtype], func(t *testing.T) {
+			resp := query(t, res, "example.test.", tt.qtype, dns.ClassINET)
+			if resp.Rcode != dns.RcodeSuccess || !resp.Authoritative {
+				t.Fatalf("rcode = %s, AA = %v, want an authoritative NOERROR", dns.RcodeToString[resp.Rcode], resp.Authoritative)
+			}
+			var answers []uint16
+			for _, rr := range resp.Answer {
+				answers = append(answers, rr.Header().Rrtype)
+			}
+			if !slices.Equal(answers, tt.answers) {
+				t.Errorf("answer types = %v, want %v", answers, tt.answers)
+			}
+			if soa := len(resp.Ns) == 1 && resp.Ns[0].Header().Rrtype == dns.TypeSOA; soa != tt.soa {
+				t.Errorf("SOA in the authority section = %v, want %v", soa, tt.soa)
+			}
+			if tt.qtype == dns.TypeA && resp.Answer[0].(*dns.A).A.String() != "10.0.0.1" {
+				t.Errorf("apex resolves to %s, want the container's 10.0.0.1", resp.Answer[0])
+			}
+		})
+	}
+}
+
+func TestResolveAAAA(t *testing.T) {
+	testConfig(t)
+	res := newTestResolver(t,
+		Service{ContainerName: "dual", HostnameLabel: "dual.local", IPAddress: net.ParseIP("10.0.0.1"), IPAddress6: net.ParseIP("fd00::1"), RecordTTL: 60},
+		Service{ContainerName: "v6", HostnameLabel: "v6.local", IPAddress6: net.ParseIP("fd00::2"), RecordTTL: 60},
+		Service{ContainerName: "v4", HostnameLabel: "v4.local", IPAddress: net.ParseIP("10.0.0.3"), RecordTTL: 60},
+	)
+
+	tests := []struct {
+		name  string
+		qname string
+		qtype uint16
+		want  []string
+	}{
+		{"dual-stack AAAA", "dual.local.", dns.TypeAAAA, []string{"fd00::1"}},
+		{"dual-stack A", "dual.local.", dns.TypeA, []string{"10.0.0.1"}},
+		{"IPv6 only AAAA", "v6.local.", dns.TypeAAAA, []string{"fd00::2"}},
+		{"IPv6 only A", "v6.local.", dns.TypeA, nil},
+		{"IPv4 only AAAA", "v4.local.", dns.TypeAAAA, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := query(t, res, tt.qname, tt.qtype, dns.ClassINET)
+			if resp.Rcode != dns.RcodeSuccess {
+				t.Fatalf("rcode = %s, want NOERROR", dns.RcodeToString[resp.Rcode])
+			}
+			var got []string
+			for _, rr := range resp.Answer {
+				if rr.Header().Rrtype != tt.qtype {
+					t.Fatalf("answer %s, want type %s", rr, dns.TypeToString[tt.qtype])
+				}
+				switch rr := rr.(type) {
+				case *dns.A:
+					got = append(got, rr.A.String())
+				case *dns.AAAA:
+					got = append(got, rr.AAAA.String())
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("answers = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeDNSAllowList(t *testing.T) {
+	tests := []struct {
+		name   string
+		allow  []string
+		remote net.Addr
+		rcode  int
+	}{
+		{"no allow list", nil, &net.UDPAddr{IP: net.ParseIP("203.0.113.7"), Port: 40000}, dns.RcodeSuccess},
+		{"in range", []string{"10.0.0.0/8"}, &net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 40000}, dns.RcodeSuccess},
+		{"out of range", []string{"10.0.0.0/8"}, &net.UDPAddr{IP: net.ParseIP("203.0.113.7"), Port: 40000}, dns.RcodeRefused},
+		{"out of range over TCP", []string{"10.0.0.0/8"}, &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 40000}, dns.RcodeRefused},
+		{"single address", []string{"10.0.0.0/8", "203.0.113.7"}, &net.UDPAddr{IP: net.ParseIP("203.0.113.7"), Port: 40000}, dns.RcodeSuccess},
+		{"next single address", []string{"203.0.113.7"}, &net.UDPAddr{IP: net.ParseIP("203.0.113.8"), Port: 40000}, dns.RcodeRefused},
+		{"IPv6 in range", []string{"fd00::/8"}, &net.UDPAddr{IP: net.ParseIP("fd00::5"), Port: 40000}, dns.RcodeSuccess},
+		{"IPv6 out of range", []string{"10.0.0.0/8"}, &net.UDPAddr{IP: net.ParseIP("2001:db8::5"), Port: 40000}, dns.RcodeRefused},
+		{"Unix socket", []string{"10.0.0.0/8"}, &net.UnixAddr{Name: "@", Net: "unix"}, dns.RcodeSuccess},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testConfig(t)
+			config.AllowCIDRs = tt.allow
+			res := newTestResolver(t, Service{ContainerName: "app", HostnameLabel: "app.local", IPAddress: net.ParseIP("10.0.0.1"), RecordTTL: 60})
+
+			r := new(dns.Msg)
+			r.SetQuestion("app.local.", dns.TypeA)
+			w := newRecordingWriter("udp")
+			w.remote = tt.remote
+			res.ServeDNS(w, r)
+			if len(w.msgs) != 1 {
+				t.Fatalf("got %d responses, want 1", len(w.msgs))
+			}
+			if resp := w.msgs[0]; resp.Rcode != tt.rcode {
+				t.Fatalf("rcode = %s, want %s", dns.RcodeToString[resp.Rcode], dns.RcodeToString[tt.rcode])
+			} else if tt.rcode == dns.RcodeRefused && len(resp.Answer) > 0 {
+				t.Errorf("refused response holds answers %v", resp.Answer)
+			}
+		})
+	}
+}
+
+func TestNewAllowList(t *testing.T) {
+	for entry, valid := range map[string]bool{
+		"10.0.0.0/8":  true,
+		" 10.0.0.1 ":  true,
+		"fd00::/64":   true,
+		"fd00::1":     true,
+		"10.0.0.0/33": false,
+		"10.0.0":      false,
+		"example.org": false,
+		"":            false,
+	} {
+		if _, err := newAllowList([]string{entry}); (err == nil) != valid {
+			t.Errorf("newAllowList(%q) error = %v, want valid %v", entry, err, valid)
+		}
+	}
+}
+
+func TestResolveAll(t *testing.T) {
+	testConfig(t)
+	config.Zones = []string{"local."}
+	res := newTestResolver(t,
+		Service{ContainerName: "app", HostnameLabel: "app.local", IPAddress: net.ParseIP("10.0.0.1"), IPAddress6: net.ParseIP("fd00::1"), RecordTTL: 60},
+		Service{ContainerName: "db", HostnameLabel: "db.local", IPAddress: net.ParseIP("10.0.0.2"), RecordTTL: 60},
+	)
+
+	tests := []struct {
+		name      string
+		questions []dns.Question
+		rcode     int
+		answers   []string // The answered addresses, in order
+	}{
+		{"A and AAAA", []dns.Question{{Name: "app.local.", Qtype: dns.TypeA}, {Name: "app.local.", Qtype: dns.TypeAAAA}}, dns.RcodeSuccess, []string{"10.0.0.1", "fd00::1"}},
+		{"two names", []dns.Question{{Name: "app.local.", Qtype: dns.TypeA}, {Name: "db.local.", Qtype: dns.TypeA}}, dns.RcodeSuccess, []string{"10.0.0.1", "10.0.0.2"}},
+		{"repeated question", []dns.Question{{Name: "app.local.", Qtype: dns.TypeA}, {Name: "APP.local.", Qtype: dns.TypeA}}, dns.RcodeSuccess, []string{"10.0.0.1"}},
+		{"unknown then known", []dns.Question{{Name: "missing.local.", Qtype: dns.TypeA}, {Name: "db.local.", Qtype: dns.TypeA}}, dns.RcodeSuccess, []string{"10.0.0.2"}},
+		{"unsupported type", []dns.Question{{Name: "app.local.", Qtype: dns.TypeHINFO}, {Name: "app.local.", Qtype: dns.TypeA}}, dns.RcodeSuccess, []string{"10.0.0.1"}},
+		{"not forwarded", []dns.Question{{Name: "app.local.", Qtype: dns.TypeA}, {Name: "example.org.", Qtype: dns.TypeA}}, dns.RcodeSuccess, []string{"10.0.0.1"}},
+		{"all unknown", []dns.Question{{Name: "missing.local.", Qtype: dns.TypeA}, {Name: "gone.local.", Qtype: dns.TypeA}}, dns.RcodeNameError, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := new(dns.Msg)
+			r.Id = dns.Id()
+			r.Question = tt.questions
+			for i := range r.Question {
+				r.Question[i].Qclass = dns.ClassINET
+			}
+
+			resp := res.resolveAll(r, nil)
+			if resp.Id != r.Id || !slices.Equal(resp.Question, r.Question) {
+				t.Fatalf("response to %d %v, want %d %v", resp.Id, resp.Question, r.Id, r.Question)
+			}
+			if resp.Rcode != tt.rcode {
+				t.Fatalf("rcode = %s, want %s", dns.RcodeToString[resp.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			var got []string
+			for _, rr := range resp.Answer {
+				switch rr := rr.(type) {
+				case *dns.A:
+					got = append(got, rr.A.String())
+				case *dns.AAAA:
+					got = append(got, rr.AAAA.String())
+				}
+			}
+			if !slices.Equal(got, tt.answers) {
+				t.Errorf("answers = %v, want %v", got, tt.answers)
+			}
+			if _, err := resp.Pack(); err != nil {
+				t.Errorf("response doesn't pack: %v", err)
+			}
+		})
+	}
+}
+
+func TestServeDNSTooManyQuestions(t *testing.T) {
+	testConfig(t)
+	res := newTestResolver(t, Service{ContainerName: "app", HostnameLabel: "app.local", IPAddress: net.ParseIP("10.0.0.1"), RecordTTL: 60})
+
+	for n, rcode := range map[int]int{maxQuestions: dns.RcodeSuccess, maxQuestions + 1: dns.RcodeFormatError} {
+		r := new(dns.Msg)
+		for range n {
+			r.Question = append(r.Question, dns.Question{Name: "app.local.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+		}
+		w := newRecordingWriter("udp")
+		res.ServeDNS(w, r)
+		if len(w.msgs) != 1 || w.msgs[0].Rcode != rcode {
+			t.Errorf("%d questions got %v, want a single %s response", n, w.msgs, dns.RcodeToString[rcode])
+		}
+	}
+}
+
+func TestResolveMaintenance(t *testing.T) {
+	testConfig(t)
+	config.Zones = []string{"local."}
+	res := newTestResolver(t, Service{ContainerName: "app", HostnameLabel: "app.local", IPAddress: net.ParseIP("10.0.0.1"), IPAddress6: net.ParseIP("fd00::1"), RecordTTL: 60})
+	previous := maintenanceIP.Load()
+	t.Cleanup(func() { maintenanceIP.Store(previous) })
+
+	tests := []struct {
+		name        string
+		maintenance string
+		qname       string
+		qtype       uint16
+		rcode       int
+		want        []string // The answered addresses
+	}{
+		{"known name", "192.0.2.10", "app.local.", dns.TypeA, dns.RcodeSuccess, []string{"192.0.2.10"}},
+		{"unrelated name", "192.0.2.10", "unrelated.local.", dns.TypeA, dns.RcodeSuccess, []string{"192.0.2.10"}},
+		{"other family", "192.0.2.10", "app.local.", dns.TypeAAAA, dns.RcodeSuccess, nil},
+		{"IPv6 address", "2001:db8::10", "unrelated.local.", dns.TypeAAAA, dns.RcodeSuccess, []string{"2001:db8::10"}},
+		{"out of zone", "192.0.2.10", "example.org.", dns.TypeA, dns.RcodeRefused, nil},
+		{"ended, known name", "", "app.local.", dns.TypeA, dns.RcodeSuccess, []string{"10.0.0.1"}},
+		{"ended, unrelated name", "", "unrelated.local.", dns.TypeA, dns.RcodeNameError, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setMaintenance(tt.maintenance)
+
+			resp := query(t, res, tt.qname, tt.qtype, dns.ClassINET)
+			if resp.Rcode != tt.rcode {
+				t.Fatalf("rcode = %s, want %s", dns.RcodeToString[resp.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			var got []string
+			for _, rr := range resp.Answer {
+				switch rr := rr.(type) {
+				case *dns.A:
+					got = append(got, rr.A.String())
+				case *dns.AAAA:
+					got = append(got, rr.AAAA.String())
+				}
+				if tt.maintenance != "" && rr.Header().Ttl != maintenanceTTL {
+					t.Errorf("answer %s, want TTL %d", rr, maintenanceTTL)
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("answers = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// subnetQuery builds an A query for `name`, with a Client Subnet option for `subnet`
+// unless it is "".
+func subnetQuery(t *testing.T, name, subnet string) *dns.Msg {
+	t.Helper()
+	r := new(dns.Msg)
+	r.SetQuestion(name, dns.TypeA)
+	if subnet == "" {
+		return r
+	}
+	_, network, err := net.ParseCIDR(subnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ones, _ := network.Mask.Size()
+	r.SetEdns0(ednsUDPSize, false)
+	r.IsEdns0().Option = append(r.IsEdns0().Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: uint8(ones), Address: network.IP})
+	return r
+}
+
+func TestResolveClientSubnet(t *testing.T) {
+	testConfig(t)
+	config.Order = "proximity"
+	res := newTestResolver(t,
+		Service{ContainerName: "app1", HostnameLabel: "app.local", IPAddress: net.ParseIP("10.1.0.5"), RecordTTL: 60},
+		Service{ContainerName: "app2", HostnameLabel: "app.local", IPAddress: net.ParseIP("10.2.0.5"), RecordTTL: 60},
+	)
+
+	tests := []struct {
+		name   string
+		peer   string
+		subnet string // The Client Subnet option, "" for none
+		first  string
+	}{
+		{"peer address", "10.1.0.100", "", "10.1.0.5"},
+		{"peer on the other subnet", "10.2.0.100", "", "10.2.0.5"},
+		{"client subnet", "10.1.0.100", "10.2.0.0/24", "10.2.0.5"},
+		{"client subnet of a single address", "10.2.0.100", "10.1.0.7/32", "10.1.0.5"},
+		{"undisclosed client subnet", "10.1.0.100", "0.0.0.0/0", "10.1.0.5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for range 20 {
+				resp, _ := res.resolve(subnetQuery(t, "app.local.", tt.subnet), net.ParseIP(tt.peer))
+				if len(resp.Answer) != 2 {
+					t.Fatalf("got %d answers, want 2", len(resp.Answer))
+				}
+				if got := resp.Answer[0].(*dns.A).A.String(); got != tt.first {
+					t.Fatalf("first answer %s, want %s", got, tt.first)
+				}
+			}
+		})
+	}
+}
+
+func TestServeDNSClientSubnetScope(t *testing.T) {
+	tests := []struct {
+		order  string
+		subnet string
+		scope  int // The echoed option's scope, -1 if it isn't echoed
+	}{
+		{"proximity", "10.2.0.0/24", 24},
+		{"affinity", "10.2.0.0/24", 24},
+		{"stable", "10.2.0.0/24", 0},
+		{"rotate", "10.2.0.0/24", 0},
+		{"proximity", "", -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.order+" "+tt.subnet, func(t *testing.T) {
+			testConfig(t)
+			config.Order = tt.order
+			res := newTestResolver(t, Service{ContainerName: "app", HostnameLabel: "app.local", IPAddress: net.ParseIP("10.1.0.5"), RecordTTL: 60})
+
+			w := newRecordingWriter("udp")
+			res.ServeDNS(w, subnetQuery(t, "app.local.", tt.subnet))
+			if len(w.msgs) != 1 {
+				t.Fatalf("got %d responses, want 1", len(w.msgs))
+			}
+			scope := -1
+			if opt := w.msgs[0].IsEdns0(); opt != nil {
+				if subnet := clientSubnet(opt); subnet != nil {
+					scope = int(subnet.SourceScope)
+					if subnet.SourceNetmask != 24 || !subnet.Address.Equal(net.ParseIP("10.2.0.0")) {
+						t.Errorf("echoed option %s, want the query's", subnet)
+					}
+				}
+			}
+			if scope != tt.scope {
+				t.Errorf("scope = %d, want %d", scope, tt.scope)
+			}
+		})
+	}
+}
+
+func BenchmarkResolve(b *testing.B) {
+	testConfig(b)
+	previous := log.Logger
+	log.Logger = zerolog.Nop()
+	b.Cleanup(func() { log.Logger = previous })
+
+	// A hostname shared by a few replicas, among many others
+	var services []Service
+	for i := range 200 {
+		services = append(services, Service{ContainerName: fmt.Sprintf("app%d", i), HostnameLabel: fmt.Sprintf("app%d.local", i), IPAddress: net.IPv4(10, 0, byte(i/256), byte(i%256)), RecordTTL: 60})
+	}
+	for i := range 4 {
+		services = append(services, Service{ContainerName: fmt.Sprintf("web%d", i), HostnameLabel: "web.local", IPAddress: net.IPv4(10, 1, 0, byte(i)), RecordTTL: 60})
+	}
+	res := newTestResolver(b, services...)
+
+	r := new(dns.Msg)
+	r.SetQuestion("web.local.", dns.TypeA)
+	client := net.ParseIP("192.0.2.1")
+
+	b.ReportAllocs()
+	for b.Loop() {
+		if resp, _ := res.resolve(r, client); len(resp.Answer) != 4 {
+			b.Fatalf("got %d answers, want 4", len(resp.Answer))
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+// Timers advertised in the SOA record of the managed domain, in seconds
+const (
+	soaRefresh = 3600
+	soaRetry   = 600
+	soaExpire  = 86400
+)
+
+// zoneName returns the fully-qualified managed domain, or "" if none is configured.
+func zoneName() string {
+	if config.Domain == "" {
+		return ""
+	}
+	return config.Domain + "."
+}
+
+// inZone reports whether `name` lies within the managed domain.
+func inZone(name string) bool {
+	zone := zoneName()
+	return zone != "" && dns.IsSubDomain(zone, name)
+}
+
+// makeSOA builds the SOA record of the managed domain with the given serial.
+func makeSOA(serial uint32) *dns.SOA {
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   zoneName(),
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    config.NegativeTTL, // Resolvers cache negative answers for the lower of this and Minttl
+		},
+		Ns:      config.SOAMname,
+		Mbox:    config.SOARname,
+		Serial:  serial,
+		Refresh: soaRefresh,
+		Retry:   soaRetry,
+		Expire:  soaExpire,
+		Minttl:  config.NegativeTTL,
+	}
+}
+
+func makeSOAResponse(serial uint32) *dns.Msg {
+	log.Debug().Msgf("Creating DNS SOA response for: %s", zoneName())
+
+	m := new(dns.Msg)
+	m.SetReply(&dns.Msg{})
+	m.Authoritative = true
+	m.RecursionAvailable = true
+	m.Answer = []dns.RR{makeSOA(serial)}
+	m.Ns = []dns.RR{makeNS()}
+
+	return m
+}
+
+// makeNS builds the NS record delegating the managed domain to AutoDNS.
+func makeNS() *dns.NS {
+	return &dns.NS{
+		Hdr: dns.RR_Header{
+			Name:   zoneName(),
+			Rrtype: dns.TypeNS,
+			Class:  dns.ClassINET,
+			Ttl:    config.TTL,
+		},
+		Ns: config.NSName,
+	}
+}
+
+// makeNSResponse answers an NS query for the managed domain, with the name server's
+// address as glue when it is one of our own names.
+func makeNSResponse(snapshot *Registry) *dns.Msg {
+	log.Debug().Msgf("Creating DNS NS response for: %s", zoneName())
+
+	m := new(dns.Msg)
+	m.SetReply(&dns.Msg{})
+	m.Authoritative = true
+	m.RecursionAvailable = true
+	m.Answer = []dns.RR{makeNS()}
+	m.Extra = glue(snapshot, config.NSName, time.Now())
+
+	return m
+}
+
+// addSOA puts the SOA record in the authority section of a negative answer for
+// `name`, if it lies within the managed domain.
+func addSOA(m *dns.Msg, name string, snapshot *Registry) *dns.Msg {
+	if inZone(name) {
+		m.Authoritative = true
+		m.Ns = append(m.Ns, makeSOA(snapshot.Serial()))
+	}
+	return m
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net"
+
+	"github.com/rs/zerolog/log"
+)
+
+// staticServices turns the configured static hosts and `AUTODNS_APEX_IP` into services,
+// skipping invalid entries.
+func staticServices() []Service {
+	var services []Service
+	for _, host := range config.Static {
+		hostname := qualifyHostname(host.Hostname)
+		if !validHostname(hostname) {
+			log.Warn().Msgf("Static host has invalid hostname %q, skipping", host.Hostname)
+			continue
+		}
+
+		ip := net.ParseIP(host.IP)
+		if ip == nil {
+			log.Warn().Msgf("Static host `%s` has an invalid IP address `%s`, skipping", host.Hostname, host.IP)
+			continue
+		}
+
+		service := Service{
+			ContainerName: "static",
+			HostnameLabel: hostname,
+			RecordTTL:     config.TTL,
+			Static:        true,
+		}
+		service.setAddress(ip)
+		services = append(services, service)
+	}
+
+	// The bare domain, e.g. pointing at a landing page
+	if ip := net.ParseIP(config.ApexIP); ip != nil && config.Domain != "" {
+		service := Service{
+			ContainerName: "apex",
+			HostnameLabel: config.Domain,
+			RecordTTL:     config.TTL,
+			Static:        true,
+		}
+		service.setAddress(ip)
+		services = append(services, service)
+	}
+	return services
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+// Build information, injected with `-ldflags "-X main.version=... -X main.commit=... -X main.buildDate=..."`
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// versionString describes the build, e.g. `v1.2.0 (commit 1a2b3c4, built 2025-01-01T00:00:00Z)`.
+func versionString() string {
+	return fmt.Sprintf("%s (commit %s, built %s)", version, commit, buildDate)
+}
+
+// startTime is when this process started, for uptime reporting
+var startTime = time.Now()
+
+// makeStatusResponse answers the reserved status name with a TXT record describing
+// the build version, the number of registered hostnames and the uptime.
+func makeStatusResponse(q dns.Question, services int) *dns.Msg {
+	log.Debug().Msgf("Creating DNS status response for: %s", q.Name)
+
+	m := new(dns.Msg)
+	m.SetReply(&dns.Msg{})
+	m.Authoritative = true
+	m.RecursionAvailable = true
+	m.Answer = []dns.RR{
+		&dns.TXT{
+			Hdr: dns.RR_Header{
+				Name:   q.Name,
+				Rrtype: dns.TypeTXT,
+				Class:  q.Qclass, // Answer in the class asked, so `dig CH TXT` works too
+				Ttl:    0,
+			},
+			Txt: []string{
+				"version=" + version,
+				"commit=" + commit,
+				fmt.Sprintf("services=%d", services),
+				"uptime=" + time.Since(startTime).Truncate(time.Second).String(),
+			},
+		},
+	}
+
+	return m
+}
+
+// makeVersionResponse answers the conventional `version.bind CH TXT` query with the
+// build version.
+func makeVersionResponse(q dns.Question) *dns.Msg {
+	log.Debug().Msgf("Creating DNS version response for: %s", q.Name)
+	return makeChaosResponse(q, "AutoDNS "+versionString())
+}
+
+// makeIdentityResponse answers the conventional `id.server` and `hostname.bind`
+// CH TXT queries with `AUTODNS_IDENTITY`.
+func makeIdentityResponse(q dns.Question) *dns.Msg {
+	log.Debug().Msgf("Creating DNS identity response for: %s", q.Name)
+	return makeChaosResponse(q, config.Identity)
+}
+
+// makeChaosResponse builds the CHAOS class TXT record `value` answering `q`.
+func makeChaosResponse(q dns.Question, value string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(&dns.Msg{})
+	m.Authoritative = true
+	m.RecursionAvailable = true
+	m.Answer = []dns.RR{
+		&dns.TXT{
+			Hdr: dns.RR_Header{
+				Name:   q.Name,
+				Rrtype: dns.TypeTXT,
+				Class:  dns.ClassCHAOS,
+				Ttl:    0,
+			},
+			Txt: []string{value},
+		},
+	}
+
+	return m
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/rs/zerolog/log"
+)
+
+// discoverSwarm registers Swarm services from their spec's `com.autodns.*` labels,
+// resolving each to its virtual IP, so tasks on every node are covered. Services with
+// `com.autodns.swarm_mode=tasks`, or without a virtual IP, resolve to the overlay
+// addresses of their running tasks instead. `host` is the Docker daemon of a manager node.
+func discoverSwarm(ctx context.Context, host string) []Service {
+	log.Info().Msg("Discovering Swarm services...")
+
+	cli, err := newDockerClient(host)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to create Docker client")
+		return nil
+	}
+	defer cli.Close()
+
+	services, err := cli.ServiceList(ctx, swarm.ServiceListOptions{Filters: discoveryFilters()})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list Swarm services, is this node a manager?")
+		return nil
+	}
+
+	// Virtual IPs refer to networks by ID, labels by name
+	networks, err := cli.NetworkList(ctx, network.ListOptions{})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list Docker networks")
+		return nil
+	}
+	networkIDs := make(map[string]string, len(networks))
+	for _, network := range networks {
+		networkIDs[network.Name] = network.ID
+	}
+
+	// Tasks are only listed once a service needs them
+	var tasks map[string][]swarm.Task
+	serviceTasks := func(id string) []swarm.Task {
+		if tasks == nil {
+			tasks = make(map[string][]swarm.Task)
+			running, err := cli.TaskList(ctx, swarm.TaskListOptions{Filters: filters.NewArgs(filters.Arg("desired-state", "running"))})
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to list Swarm tasks")
+			}
+			for _, task := range running {
+				tasks[task.ServiceID] = append(tasks[task.ServiceID], task)
+			}
+		}
+		return tasks[id]
+	}
+
+	var discovered []Service
+	for _, service := range services {
+		// Reuse the container label helpers on the service spec
+		labelled := container.Summary{Names: []string{service.Spec.Name}, Labels: service.Spec.Labels}
+		if containerIgnored(labelled) {
+			log.Debug().Msgf("Swarm service `%s` is ignored with `%s`, skipping", service.Spec.Name, labelKey("ignore"))
+			continue
+		}
+
+		hostnames := splitHostnames(labelled, service.Spec.Labels[labelKey("hostname")])
+		if len(hostnames) == 0 {
+			log.Debug().Msgf("Swarm service `%s` has no hostname label, skipping", service.Spec.Name)
+			continue
+		}
+
+		var addresses [][]net.IP
+		mode := swarmMode(service)
+		if mode == "vip" {
+			if ip := swarmVIP(service, networkIDs); ip != nil {
+				addresses = [][]net.IP{{ip}}
+			} else {
+				log.Debug().Msgf("Swarm service `%s` has no virtual IP, resolving to its tasks", service.Spec.Name)
+			}
+		}
+		if addresses == nil {
+			addresses = swarmTaskIPs(service, serviceTasks(service.ID), networkIDs)
+		}
+		if len(addresses) == 0 {
+			log.Warn().Msgf("Swarm service `%s` has no virtual IP or running task on network `%s`, skipping", service.Spec.Name, service.Spec.Labels[labelKey("network")])
+			continue
+		}
+
+		// One entry per task, like containers sharing a hostname
+		for _, ips := range addresses {
+			entry := Service{
+				ContainerName: service.Spec.Name,
+				TXT:           containerTXT(labelled),
+				RecordTTL:     containerTTL(labelled),
+				ExpiresAt:     containerExpiry(labelled),
+			}
+			for _, ip := range ips {
+				entry.setAddress(ip)
+			}
+
+			for _, hostname := range hostnames {
+				entry.HostnameLabel = hostname
+				discovered = append(discovered, entry)
+			}
+		}
+	}
+
+	log.Info().Msgf("Discovered %d Swarm services", len(discovered))
+	return discovered
+}
+
+// swarmVIP returns the service's virtual IP on the network named by its
+// `com.autodns.network` label, or on its first network other than the ingress one.
+func swarmVIP(service swarm.Service, networkIDs map[string]string) net.IP {
+	wanted, ok := service.Spec.Labels[labelKey("network")]
+	for _, vip := range service.Endpoint.VirtualIPs {
+		if ok && vip.NetworkID != networkIDs[wanted] {
+			continue
+		}
+		if !ok && vip.NetworkID == networkIDs["ingress"] {
+			continue
+		}
+
+		ip, _, err := net.ParseCIDR(vip.Addr)
+		if err != nil {
+			continue
+		}
+		return ip
+	}
+	return nil
+}
+
+// swarmMode returns how the service resolves by its `com.autodns.swarm_mode` label:
+// "vip" for its virtual IP, the default, or "tasks" for the addresses of its tasks.
+func swarmMode(service swarm.Service) string {
+	switch value := strings.ToLower(strings.TrimSpace(service.Spec.Labels[labelKey("swarm_mode")])); value {
+	case "", "vip":
+		return "vip"
+	case "tasks":
+		return "tasks"
+	default:
+		log.Warn().Msgf("Swarm service `%s` has an invalid %s %q, expected `vip` or `tasks`, using `vip`", service.Spec.Name, labelKey("swarm_mode"), value)
+		return "vip"
+	}
+}
+
+// swarmTaskIPs returns the addresses of each of the service's running tasks, on the
+// network named by its `com.autodns.network` label, or on their first network other
+// than the ingress one, like swarmVIP. Tasks on other nodes are reached over the overlay.
+func swarmTaskIPs(service swarm.Service, tasks []swarm.Task, networkIDs map[string]string) [][]net.IP {
+	wanted, ok := service.Spec.Labels[labelKey("network")]
+
+	var addresses [][]net.IP
+	for _, task := range tasks {
+		if task.ServiceID != service.ID || task.Status.State != swarm.TaskStateRunning {
+			continue
+		}
+		for _, attachment := range task.NetworksAttachments {
+			if ok && attachment.Network.ID != networkIDs[wanted] {
+				continue
+			}
+			if !ok && (attachment.Network.ID == networkIDs["ingress"] || attachment.Network.Spec.Ingress) {
+				continue
+			}
+
+			var ips []net.IP
+			for _, addr := range attachment.Addresses {
+				if ip, _, err := net.ParseCIDR(addr); err == nil {
+					ips = append(ips, ip)
+				}
+			}
+			if len(ips) > 0 {
+				addresses = append(addresses, ips)
+				break
+			}
+		}
+	}
+	return addresses
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// testSwarmService returns a Swarm service with `labels`, its virtual IPs on `vips` by
+// network ID, and running tasks on two nodes.
+func testSwarmService(labels map[string]string, vips map[string]string) (swarm.Service, []swarm.Task) {
+	service := swarm.Service{ID: "svc", Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Name: "web", Labels: labels}}}
+	for _, id := range []string{"ingress-id", "app-id", "db-id"} {
+		if addr, ok := vips[id]; ok {
+			service.Endpoint.VirtualIPs = append(service.Endpoint.VirtualIPs, swarm.EndpointVirtualIP{NetworkID: id, Addr: addr})
+		}
+	}
+
+	task := func(node string, state swarm.TaskState, ingress string, app ...string) swarm.Task {
+		return swarm.Task{ServiceID: "svc", NodeID: node, Status: swarm.TaskStatus{State: state}, NetworksAttachments: []swarm.NetworkAttachment{
+			{Network: swarm.Network{ID: "ingress-id"}, Addresses: []string{ingress}},
+			{Network: swarm.Network{ID: "app-id"}, Addresses: app},
+		}}
+	}
+	tasks := []swarm.Task{
+		task("node-1", swarm.TaskStateRunning, "10.255.0.5/16", "10.0.1.5/24", "fd00::5/64"),
+		task("node-2", swarm.TaskStateRunning, "10.255.0.6/16", "10.0.1.6/24"),
+		task("node-2", swarm.TaskStateShutdown, "10.255.0.7/16", "10.0.1.7/24"),
+		{ServiceID: "other", Status: swarm.TaskStatus{State: swarm.TaskStateRunning}, NetworksAttachments: []swarm.NetworkAttachment{
+			{Network: swarm.Network{ID: "app-id"}, Addresses: []string{"10.0.1.9/24"}},
+		}},
+	}
+	return service, tasks
+}
+
+func TestSwarmAddresses(t *testing.T) {
+	testConfig(t)
+	networkIDs := map[string]string{"ingress": "ingress-id", "app_net": "app-id", "db_net": "db-id"}
+
+	tests := []struct {
+		name   string
+		labels map[string]string
+		vips   map[string]string
+		mode   string
+		vip    string // The virtual IP picked in "vip" mode, "" for none
+		tasks  string // The task addresses
+	}{
+		{"vip by default", map[string]string{}, map[string]string{"ingress-id": "10.255.0.2/16", "app-id": "10.0.1.2/24"}, "vip", "10.0.1.2", "[[10.0.1.5 fd00::5] [10.0.1.6]]"},
+		{"vip on the labelled network", map[string]string{"com.autodns.network": "app_net", "com.autodns.swarm_mode": "VIP"}, map[string]string{"app-id": "10.0.1.2/24"}, "vip", "10.0.1.2", "[[10.0.1.5 fd00::5] [10.0.1.6]]"},
+		{"tasks", map[string]string{"com.autodns.swarm_mode": "tasks"}, map[string]string{"app-id": "10.0.1.2/24"}, "tasks", "10.0.1.2", "[[10.0.1.5 fd00::5] [10.0.1.6]]"},
+		{"tasks off the labelled network", map[string]string{"com.autodns.network": "db_net", "com.autodns.swarm_mode": "tasks"}, nil, "tasks", "", "[]"},
+		{"invalid mode", map[string]string{"com.autodns.swarm_mode": "dnsrr"}, nil, "vip", "", "[[10.0.1.5 fd00::5] [10.0.1.6]]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, tasks := testSwarmService(tt.labels, tt.vips)
+			if got := swarmMode(service); got != tt.mode {
+				t.Errorf("mode = %s, want %s", got, tt.mode)
+			}
+			if got := swarmVIP(service, networkIDs); !got.Equal(net.ParseIP(tt.vip)) {
+				t.Errorf("virtual IP = %v, want %q", got, tt.vip)
+			}
+			if got := fmt.Sprint(swarmTaskIPs(service, tasks, networkIDs)); got != tt.tasks {
+				t.Errorf("task addresses = %s, want %s", got, tt.tasks)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"cmp"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// traefikRuleLabelRe matches router rule labels, capturing the router name
+	traefikRuleLabelRe = regexp.MustCompile(`^traefik\.http\.routers\.([\w\-]+)\.rule$`)
+	// traefikHostRe matches each `Host(...)` matcher in a rule, capturing its arguments
+	traefikHostRe = regexp.MustCompile(`\bHost\(([^)]*)\)`)
+	// traefikHostRegexpRe matches `HostRegexp(...)` matchers, which can't be turned into records
+	traefikHostRegexpRe = regexp.MustCompile(`\bHostRegexp\(`)
+	// traefikLiteralRe matches the backtick- or quote-delimited strings in a matcher's arguments
+	traefikLiteralRe = regexp.MustCompile("`([^`]*)`|\"([^\"]*)\"")
+)
+
+// Traefik is a discovered Traefik container. Its embedded Service holds the address
+// routed services resolve to by default, picked by its own `com.autodns.ip` or
+// `com.autodns.network` labels.
+type Traefik struct {
+	Service
+	networks map[string]Service // Its address on each attached network
+}
+
+// On returns Traefik's address on `network`, or the default one if `network` is "".
+func (t *Traefik) On(network string) (Service, bool) {
+	if network == "" {
+		return t.Service, true
+	}
+	service, ok := t.networks[network]
+	return service, ok
+}
+
+// traefikRouter is a router declared by a container's `traefik.http.routers.<name>.*` labels.
+type traefikRouter struct {
+	name        string
+	rule        string
+	priority    int
+	entrypoints []string // Empty if bound to Traefik's default entrypoints
+}
+
+// servedEntrypoint reports whether the router is bound to one of `AUTODNS_TRAEFIK_ENTRYPOINTS`,
+// or the filter is unset. Routers bound to the default entrypoints always pass.
+func (r traefikRouter) servedEntrypoint() bool {
+	if len(config.TraefikEntrypoints) == 0 || len(r.entrypoints) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(r.entrypoints, func(entrypoint string) bool {
+		return slices.Contains(config.TraefikEntrypoints, entrypoint)
+	})
+}
+
+// traefikRouters lists the container's routers by descending priority, then by name.
+// Like Traefik, a router without a `priority` label defaults to the length of its rule.
+func traefikRouters(container container.Summary) []traefikRouter {
+	var routers []traefikRouter
+	for label, rule := range container.Labels {
+		matches := traefikRuleLabelRe.FindStringSubmatch(label)
+		if matches == nil {
+			continue
+		}
+		router := traefikRouter{name: matches[1], rule: rule, priority: len(rule)}
+		for _, entrypoint := range strings.Split(container.Labels["traefik.http.routers."+router.name+".entrypoints"], ",") {
+			if entrypoint = strings.TrimSpace(entrypoint); entrypoint != "" {
+				router.entrypoints = append(router.entrypoints, entrypoint)
+			}
+		}
+		if value, ok := container.Labels["traefik.http.routers."+router.name+".priority"]; ok {
+			priority, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				log.Warn().Msgf("Router `%s` of container `%s` has an invalid priority %q, ignoring it", router.name, containerName(container), value)
+			} else {
+				router.priority = priority
+			}
+		}
+		routers = append(routers, router)
+	}
+
+	slices.SortFunc(routers, func(a, b traefikRouter) int {
+		return cmp.Or(cmp.Compare(b.priority, a.priority), cmp.Compare(a.name, b.name))
+	})
+	return routers
+}
+
+// rewriteTraefikHost swaps a trailing `AUTODNS_TRAEFIK_STRIP_SUFFIX` of `host` for
+// `AUTODNS_TRAEFIK_APPEND_SUFFIX`, e.g. `app.example.com` to `app.example.internal`.
+// Hosts not ending with the suffix are returned as is.
+func rewriteTraefikHost(host string) string {
+	if config.TraefikStripSuffix == "" {
+		return host
+	}
+	prefix, ok := strings.CutSuffix(strings.TrimSuffix(strings.ToLower(host), "."), "."+config.TraefikStripSuffix)
+	if !ok || prefix == "" {
+		return host
+	}
+	if config.TraefikAppendSuffix == "" {
+		return prefix
+	}
+	return prefix + "." + config.TraefikAppendSuffix
+}
+
+// parseTraefikRule extracts every hostname literal from the `Host()` matchers of a
+// Traefik rule, such as: Host(`a.local`) || (Host(`b.local`) && PathPrefix(`/api`))
+// It also reports whether the rule uses `HostRegexp()`, which isn't supported.
+func parseTraefikRule(rule string) (hosts []string, hasRegexp bool) {
+	for _, matcher := range traefikHostRe.FindAllStringSubmatch(rule, -1) {
+		// Traefik v2 allows several hosts in one matcher: Host(`a`, `b`)
+		for _, literal := range traefikLiteralRe.FindAllStringSubmatch(matcher[1], -1) {
+			host := strings.TrimSpace(literal[1] + literal[2])
+			if host != "" {
+				hosts = append(hosts, host)
+			}
+		}
+	}
+
+	return hosts, traefikHostRegexpRe.MatchString(rule)
+}
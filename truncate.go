@@ -0,0 +1,46 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+// truncatingWriter keeps UDP responses within the client's buffer size. A response
+// that doesn't fit is replaced by an empty one with the TC bit set, telling the client
+// to retry over TCP, where the full answer is sent.
+type truncatingWriter struct {
+	dns.ResponseWriter
+	size int
+}
+
+// newTruncatingWriter wraps `w` with the buffer size advertised by `r` through EDNS0,
+// or the classic 512 bytes if it advertises none.
+func newTruncatingWriter(w dns.ResponseWriter, r *dns.Msg) truncatingWriter {
+	size := dns.MinMsgSize
+	if opt := r.IsEdns0(); opt != nil {
+		size = max(int(opt.UDPSize()), dns.MinMsgSize)
+	}
+	return truncatingWriter{ResponseWriter: w, size: size}
+}
+
+func (w truncatingWriter) WriteMsg(m *dns.Msg) error {
+	// Compression often keeps a response within the buffer that wouldn't fit otherwise
+	m.Compress = config.Compress
+
+	if w.LocalAddr().Network() == "udp" && m.Len() > w.size {
+		opt := m.IsEdns0()
+		m.Extra = nil
+		if opt != nil {
+			m.Extra = []dns.RR{opt} // Still answer EDNS0 with EDNS0
+		}
+
+		// Additional records are optional, leaving them out doesn't truncate the answer
+		if m.Len() > w.size {
+			log.Debug().Msgf("Response of %d bytes exceeds the client's %d byte buffer, truncating", m.Len(), w.size)
+			m.Truncated = true
+			m.Answer = nil
+			m.Ns = nil
+		}
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestTruncatingWriter(t *testing.T) {
+	testConfig(t)
+
+	// Far more than 512 bytes of addresses
+	var ips []net.IP
+	for i := range 64 {
+		ips = append(ips, net.IPv4(10, 0, 0, byte(i)))
+	}
+
+	tests := []struct {
+		name      string
+		network   string
+		udpSize   uint16 // EDNS0 buffer size of the query, 0 for none
+		truncated bool
+	}{
+		{"UDP without EDNS0", "udp", 0, true},
+		{"UDP with a small EDNS0 buffer", "udp", 512, true},
+		{"UDP with a large EDNS0 buffer", "udp", 4096, false},
+		{"TCP without EDNS0", "tcp", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := new(dns.Msg)
+			r.SetQuestion("app.local.", dns.TypeA)
+			if tt.udpSize > 0 {
+				r.SetEdns0(tt.udpSize, false)
+			}
+
+			rec := newRecordingWriter(tt.network)
+			w := newEDNSWriter(newTruncatingWriter(rec, r), r)
+			resp := makeResponse("app.local.", ips, 60, true)
+			resp.SetReply(r)
+			if err := w.WriteMsg(resp); err != nil {
+				t.Fatal(err)
+			}
+
+			got := rec.msgs[0]
+			if got.Truncated != tt.truncated {
+				t.Fatalf("TC = %v, want %v", got.Truncated, tt.truncated)
+			}
+			if tt.truncated && len(got.Answer) != 0 {
+				t.Errorf("truncated response still has %d answers", len(got.Answer))
+			}
+			if !tt.truncated && len(got.Answer) != len(ips) {
+				t.Errorf("got %d answers, want %d", len(got.Answer), len(ips))
+			}
+			if (got.IsEdns0() != nil) != (tt.udpSize > 0) {
+				t.Errorf("OPT record present = %v, want %v", got.IsEdns0() != nil, tt.udpSize > 0)
+			}
+		})
+	}
+}
+
+func TestTruncatingWriterDropsAdditional(t *testing.T) {
+	testConfig(t)
+	r := new(dns.Msg)
+	r.SetQuestion("app.local.", dns.TypeA)
+	r.SetEdns0(512, false)
+
+	// The answer fits on its own, the additional records don't
+	resp := makeResponse("app.local.", []net.IP{net.IPv4(10, 0, 0, 1)}, 60, true)
+	resp.SetReply(r)
+	for i := range 64 {
+		resp.Extra = append(resp.Extra, makeResponse("other.local.", []net.IP{net.IPv4(10, 0, 1, byte(i))}, 60, true).Answer...)
+	}
+
+	rec := newRecordingWriter("udp")
+	if err := newEDNSWriter(newTruncatingWriter(rec, r), r).WriteMsg(resp); err != nil {
+		t.Fatal(err)
+	}
+	got := rec.msgs[0]
+	if got.Truncated || len(got.Answer) != 1 {
+		t.Fatalf("TC = %v with %d answers, want the whole answer untruncated", got.Truncated, len(got.Answer))
+	}
+	if len(got.Extra) != 1 || got.IsEdns0() == nil {
+		t.Errorf("got %d additional records, want only the OPT record", len(got.Extra))
+	}
+}
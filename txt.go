@@ -0,0 +1,49 @@
+package main
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+// maxTXTString is the longest character-string a TXT record can hold
+const maxTXTString = 255
+
+// splitTXT chunks `value` into character-strings of at most 255 bytes each.
+func splitTXT(value string) []string {
+	var chunks []string
+	for len(value) > maxTXTString {
+		chunks = append(chunks, value[:maxTXTString])
+		value = value[maxTXTString:]
+	}
+	return append(chunks, value)
+}
+
+// makeTXTResponse builds a TXT record for each value of the live services.
+func makeTXTResponse(h string, services []Service, now time.Time) *dns.Msg {
+	log.Debug().Msgf("Creating DNS TXT response for: %s", h)
+
+	var records []dns.RR
+	for _, service := range liveServices(services, now) {
+		for _, value := range service.TXT {
+			records = append(records, &dns.TXT{
+				Hdr: dns.RR_Header{
+					Name:   h,
+					Rrtype: dns.TypeTXT,
+					Class:  dns.ClassINET,
+					Ttl:    service.TTL(now),
+				},
+				Txt: splitTXT(value),
+			})
+		}
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(&dns.Msg{})
+	m.Authoritative = true
+	m.RecursionAvailable = true
+	m.Answer = records
+
+	return m
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/rs/zerolog/log"
+)
+
+// watchEvents subscribes to Docker container lifecycle events and calls `refresh` once
+// a burst of events has settled for `AUTODNS_EVENT_DEBOUNCE`. If the event stream
+// breaks, it reconnects after a short delay until `ctx` is cancelled. `host` is the
+// Docker daemon to watch.
+func watchEvents(ctx context.Context, host string, refresh func()) {
+	options := events.ListOptions{
+		Filters: filters.NewArgs(
+			filters.Arg("type", string(events.ContainerEventType)),
+			filters.Arg("event", string(events.ActionStart)),
+			filters.Arg("event", string(events.ActionDie)),
+			filters.Arg("event", string(events.ActionDestroy)),
+		),
+	}
+
+	// Debounce bursts, e.g. a compose `up` starting many containers at once
+	debounce := time.NewTimer(config.EventDebounce)
+	debounce.Stop()
+	defer debounce.Stop()
+
+	for {
+		cli, err := newDockerClient(host)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to create Docker client for event watching")
+		} else {
+			log.Info().Msgf("Watching Docker events on host `%s`...", dockerHostName(host))
+			messages, errs := cli.Events(ctx, options)
+			err = consumeEvents(ctx, messages, errs, debounce, refresh)
+			cli.Close()
+			if ctx.Err() != nil {
+				return
+			}
+			log.Warn().Err(err).Msgf("Docker event stream of host `%s` closed", dockerHostName(host))
+		}
+
+		// Retry after a delay, still handling any pending refresh
+		retry := time.NewTimer(5 * time.Second)
+		select {
+		case <-ctx.Done():
+			retry.Stop()
+			return
+		case <-debounce.C:
+			retry.Stop()
+			refresh()
+		case <-retry.C:
+		}
+	}
+}
+
+// consumeEvents reads events until the stream fails or `ctx` is cancelled, (re)arming
+// the debounce timer on each event and refreshing when it fires.
+func consumeEvents(ctx context.Context, messages <-chan events.Message, errs <-chan error, debounce *time.Timer, refresh func()) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-errs:
+			return err
+		case message := <-messages:
+			log.Debug().Msgf("Docker event `%s` for container `%s`", message.Action, message.Actor.Attributes["name"])
+			debounce.Reset(config.EventDebounce)
+		case <-debounce.C:
+			refresh()
+		}
+	}
+}
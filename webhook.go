@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// webhookTimeout bounds each delivery attempt to `AUTODNS_WEBHOOK_URL`
+const webhookTimeout = 5 * time.Second
+
+// webhookEvent is the JSON body POSTed to `AUTODNS_WEBHOOK_URL` when the records change.
+type webhookEvent struct {
+	Serial  uint32   `json:"serial"`
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Changed []string `json:"changed"`
+}
+
+// notifyWebhook delivers `event` to `AUTODNS_WEBHOOK_URL`, retrying once on failure.
+// It runs in its own goroutine, so a slow receiver never holds up discovery.
+func notifyWebhook(event webhookEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to encode webhook event")
+		return
+	}
+
+	client := &http.Client{Timeout: webhookTimeout}
+	for attempt := 1; attempt <= 2; attempt++ {
+		err = postWebhook(client, body)
+		if err == nil {
+			log.Debug().Msgf("Notified webhook of serial %d", event.Serial)
+			return
+		}
+		log.Warn().Err(err).Msgf("Failed to notify webhook (attempt %d of 2)", attempt)
+	}
+}
+
+func postWebhook(client *http.Client, body []byte) error {
+	resp, err := client.Post(config.WebhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status `%s`", resp.Status)
+	}
+	return nil
+}
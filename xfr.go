@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+// xfrAllowed reports whether `addr` is in `AUTODNS_XFR_ALLOW`.
+func xfrAllowed(addr net.Addr) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, allowed := range config.XFRAllow {
+		if _, network, err := net.ParseCIDR(allowed); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if ip.Equal(net.ParseIP(allowed)) {
+			return true
+		}
+	}
+	return false
+}
+
+// zoneRecords collects every live record within the managed domain.
+func zoneRecords(snapshot *Registry, now time.Time) []dns.RR {
+	var records []dns.RR
+	for _, record := range allRecords(snapshot, now) {
+		if inZone(record.Header().Name) {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// allRecords collects every live record of the registry, in or out of the managed domain.
+func allRecords(snapshot *Registry, now time.Time) []dns.RR {
+	var records []dns.RR
+	for _, name := range snapshot.Names() {
+		services, _ := snapshot.Lookup(name)
+		if !anyLive(services, now) {
+			continue
+		}
+
+		if alias := services[0]; alias.CNAME != "" {
+			records = append(records, makeCNAMEResponse(name, alias.CNAME, alias.TTL(now), dns.TypeCNAME, snapshot).Answer...)
+			continue
+		}
+		records = append(records, makeANYResponse(name, services, snapshot, now, []uint16{dns.TypeA, dns.TypeAAAA}).Answer...)
+	}
+
+	// SRV records live under their own `_service._proto` names
+	for _, name := range snapshot.SRVNames() {
+		srv, _ := snapshot.LookupSRV(name)
+		records = append(records, makeSRVResponse(name, srv, now).Answer...)
+	}
+	return records
+}
+
+// serveAXFR transfers the managed domain to an allowed client over TCP, bracketing its
+// records with the SOA record as AXFR requires.
+func serveAXFR(w dns.ResponseWriter, r *dns.Msg, snapshot *Registry) {
+	name := r.Question[0].Name
+	refuse := func(reason string) {
+		log.Warn().Msgf("Refusing AXFR of %s from %s: %s", name, w.RemoteAddr(), reason)
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeRefused)
+		w.WriteMsg(m)
+	}
+
+	switch {
+	case config.Domain == "" || !strings.EqualFold(dns.Fqdn(name), zoneName()):
+		refuse("not the managed domain")
+		return
+	case w.LocalAddr().Network() != "tcp" || w.Network() == "https":
+		// DoH answers a request with a single message, too few for a transfer
+		refuse("transfers need TCP")
+		return
+	case !xfrAllowed(w.RemoteAddr()):
+		refuse("client not in AUTODNS_XFR_ALLOW")
+		return
+	}
+
+	soa := makeSOA(snapshot.Serial())
+	records := append([]dns.RR{soa, makeNS()}, zoneRecords(snapshot, time.Now())...)
+	records = append(records, soa)
+
+	// Send the records in batches, each in its own message
+	ch := make(chan *dns.Envelope)
+	go func() {
+		defer close(ch)
+		const batch = 100
+		for len(records) > 0 {
+			n := min(batch, len(records))
+			ch <- &dns.Envelope{RR: records[:n]}
+			records = records[n:]
+		}
+	}()
+
+	transfer := new(dns.Transfer)
+	if err := transfer.Out(w, r, ch); err != nil {
+		log.Error().Err(err).Msgf("Failed to transfer %s to %s", name, w.RemoteAddr())
+		for range ch {
+		}
+		return
+	}
+	log.Info().Msgf("Transferred %s (serial %d) to %s", name, soa.Serial, w.RemoteAddr())
+}
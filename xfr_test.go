@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// recordingWriter is a dns.ResponseWriter keeping every message written to it.
+type recordingWriter struct {
+	local, remote net.Addr
+	network       string
+	msgs          []*dns.Msg
+}
+
+func newRecordingWriter(network string) *recordingWriter {
+	local, remote := net.Addr(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}), net.Addr(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000})
+	if network == "udp" {
+		local, remote = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	}
+	return &recordingWriter{local: local, remote: remote, network: network}
+}
+
+func (w *recordingWriter) LocalAddr() net.Addr  { return w.local }
+func (w *recordingWriter) RemoteAddr() net.Addr { return w.remote }
+func (w *recordingWriter) Network() string      { return w.network }
+
+func (w *recordingWriter) WriteMsg(m *dns.Msg) error {
+	// Pack like a real writer would, so truncation and compression settings apply
+	if _, err := m.Pack(); err != nil {
+		return err
+	}
+	w.msgs = append(w.msgs, m)
+	return nil
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *recordingWriter) Close() error                { return nil }
+func (w *recordingWriter) TsigStatus() error           { return nil }
+func (w *recordingWriter) TsigTimersOnly(bool)         {}
+func (w *recordingWriter) Hijack()                     {}
+
+func TestServeAXFR(t *testing.T) {
+	testConfig(t)
+	config.Domain = "example.test"
+	config.XFRAllow = []string{"127.0.0.1"}
+
+	// Enough records for several transfer messages
+	var services []Service
+	for i := range 150 {
+		services = append(services, Service{
+			ContainerName: fmt.Sprintf("app%d", i),
+			HostnameLabel: fmt.Sprintf("app%d.example.test", i),
+			IPAddress:     net.IPv4(10, 0, byte(i/256), byte(i%256)),
+			RecordTTL:     60,
+		})
+	}
+	snapshot := newRegistry(services)
+
+	tests := []struct {
+		name    string
+		writer  func() dns.ResponseWriter
+		refused bool
+	}{
+		{"over TCP", func() dns.ResponseWriter { return newRecordingWriter("tcp") }, false},
+		{"over UDP", func() dns.ResponseWriter { return newRecordingWriter("udp") }, true},
+		{"over DoH", func() dns.ResponseWriter {
+			return &dohWriter{local: &net.TCPAddr{}, remote: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}}
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := new(dns.Msg)
+			r.SetAxfr("example.test.")
+
+			w := tt.writer()
+			serveAXFR(w, r, snapshot)
+
+			var msgs []*dns.Msg
+			switch w := w.(type) {
+			case *recordingWriter:
+				msgs = w.msgs
+			case *dohWriter:
+				msgs = []*dns.Msg{w.msg}
+			}
+
+			if tt.refused {
+				if len(msgs) != 1 || msgs[0].Rcode != dns.RcodeRefused {
+					t.Fatalf("got %d messages, want a single REFUSED one", len(msgs))
+				}
+				return
+			}
+
+			if len(msgs) < 2 {
+				t.Fatalf("got %d messages, want the zone split over several", len(msgs))
+			}
+			first, last := msgs[0].Answer, msgs[len(msgs)-1].Answer
+			if first[0].Header().Rrtype != dns.TypeSOA || last[len(last)-1].Header().Rrtype != dns.TypeSOA {
+				t.Fatalf("transfer is not bracketed by SOA records")
+			}
+		})
+	}
+}
+
+func TestAllRecordsUnjittered(t *testing.T) {
+	testConfig(t)
+	config.TTLJitter = 50
+	snapshot := newRegistry([]Service{{ContainerName: "app", HostnameLabel: "app.local", IPAddress: net.ParseIP("10.0.0.1"), RecordTTL: 3600}})
+
+	for range 20 {
+		for _, rr := range allRecords(snapshot, time.Now()) {
+			if rr.Header().Ttl != 3600 {
+				t.Fatalf("record %s has TTL %d, want the unjittered 3600", rr, rr.Header().Ttl)
+			}
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+// zonefileServices holds the records last read from `AUTODNS_ZONEFILE`.
+var zonefileServices atomic.Pointer[[]Service]
+
+// loadZonefile parses `AUTODNS_ZONEFILE` and keeps its records for the following
+// discovery runs. On failure, the records read before stay in place.
+func loadZonefile() error {
+	services, err := parseZonefile(config.Zonefile)
+	if err != nil {
+		return err
+	}
+	log.Info().Msgf("Loaded %d records from zone file `%s`", len(services), config.Zonefile)
+	zonefileServices.Store(&services)
+	return nil
+}
+
+// parseZonefile reads the A, AAAA, CNAME, TXT, MX and SRV records of a BIND-style zone
+// file into static services. Relative names are taken to be under `AUTODNS_DOMAIN`.
+func parseZonefile(path string) ([]Service, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open zone file: %w", err)
+	}
+	defer file.Close()
+
+	var services []Service
+	records := make(map[string]*Service) // TXT, MX and SRV data of each name
+	recordsOf := func(hostname string, ttl uint32) *Service {
+		if records[hostname] == nil {
+			records[hostname] = &Service{ContainerName: "zonefile", HostnameLabel: hostname, RecordTTL: ttl, Static: true}
+		}
+		return records[hostname]
+	}
+
+	zp := dns.NewZoneParser(file, zoneName(), path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		hdr := rr.Header()
+		hostname := strings.TrimSuffix(strings.ToLower(hdr.Name), ".")
+		service := Service{ContainerName: "zonefile", HostnameLabel: hostname, RecordTTL: hdr.Ttl, Static: true}
+
+		switch rr := rr.(type) {
+		case *dns.A:
+			service.IPAddress = rr.A
+			services = append(services, service)
+		case *dns.AAAA:
+			service.IPAddress6 = rr.AAAA
+			services = append(services, service)
+		case *dns.CNAME:
+			service.CNAME = strings.ToLower(rr.Target)
+			services = append(services, service)
+		case *dns.TXT:
+			data := recordsOf(hostname, hdr.Ttl)
+			data.TXT = append(data.TXT, strings.Join(rr.Txt, ""))
+		case *dns.MX:
+			data := recordsOf(hostname, hdr.Ttl)
+			data.MX = append(data.MX, MXRecord{Preference: rr.Preference, Target: strings.ToLower(rr.Mx)})
+		case *dns.SRV:
+			// SRV records live at `_service._proto.<hostname>`
+			labels := strings.SplitN(hostname, ".", 3)
+			if len(labels) != 3 || !strings.HasPrefix(labels[0], "_") || !strings.HasPrefix(labels[1], "_") {
+				log.Warn().Msgf("Zone file SRV record `%s` is not named `_service._proto.<hostname>`, skipping", hdr.Name)
+				continue
+			}
+			data := recordsOf(labels[2], hdr.Ttl)
+			data.SRV = append(data.SRV, SRVRecord{
+				Service:  labels[0] + "." + labels[1],
+				Priority: rr.Priority,
+				Weight:   rr.Weight,
+				Port:     rr.Port,
+				Target:   strings.ToLower(rr.Target),
+			})
+		case *dns.SOA, *dns.NS:
+			// AutoDNS serves its own
+		default:
+			log.Warn().Msgf("Zone file record type `%s` of `%s` is not supported, skipping", dns.TypeToString[hdr.Rrtype], hdr.Name)
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return nil, fmt.Errorf("failed to parse zone file `%s`: %w", path, err)
+	}
+
+	for _, data := range records {
+		services = append(services, *data)
+	}
+	return services, nil
+}
+
+// mergeZonefile adds the zone file's records to `services`. Unless `AUTODNS_ZONEFILE_OVERRIDE`
+// is set, names that are discovered leave the zone file's records for them out.
+func mergeZonefile(services []Service) []Service {
+	zonefile := zonefileServices.Load()
+	if zonefile == nil {
+		return services
+	}
+	if config.ZonefileOverride {
+		return append(services, *zonefile...)
+	}
+
+	discovered := make(map[string]bool, len(services))
+	for _, service := range services {
+		discovered[service.HostnameLabel] = true
+	}
+	for _, service := range *zonefile {
+		if discovered[service.HostnameLabel] {
+			log.Debug().Msgf("Zone file records of `%s` are overridden by a discovered service", service.HostnameLabel)
+			continue
+		}
+		services = append(services, service)
+	}
+	return services
+}
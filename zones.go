@@ -0,0 +1,37 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+)
+
+// ownedZones returns the zones AutoDNS answers authoritatively for: `AUTODNS_ZONES` if
+// set, otherwise the managed domain, the dynamic zone and the name zone.
+func ownedZones() []string {
+	if len(config.Zones) > 0 {
+		return config.Zones
+	}
+
+	var zones []string
+	if zone := zoneName(); zone != "" {
+		zones = append(zones, zone)
+	}
+	if config.DynamicZone != "" {
+		zones = append(zones, config.DynamicZone)
+	}
+	if config.NameZone != "" {
+		zones = append(zones, config.NameZone)
+	}
+	return zones
+}
+
+// ownsName reports whether AutoDNS is authoritative for `name`: it lies within an
+// owned zone or, without explicit zones, is a name we hold records for. Other names
+// are forwarded upstream or refused.
+func ownsName(name string, snapshot *Registry) bool {
+	for _, zone := range ownedZones() {
+		if dns.IsSubDomain(zone, name) {
+			return true
+		}
+	}
+	return len(config.Zones) == 0 && snapshot.Exists(name)
+}